@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"copycat-imap/copycat"
+)
+
+const cacheUsage = `Usage: copycat-imap cache <command> [flags] [args]
+
+Commands:
+  stats               count, size and the oldest/newest message in the cache
+  list [filter]       list the cached messages, optionally only ids containing filter
+  show <id>           print a cached message
+  dump <id> <file>    write a cached message to an .eml file
+  delete <id>...      remove messages from the cache
+  verify              decode every message and report any that are corrupt
+  prune <age>         remove messages that arrived more than age (ie. '2160h') ago
+  import <path>...    cache the messages in mbox files or Maildirs so a first sync
+                      doesn't download them. use the same -identity as the sync.
+
+The cache is opened with the -db, -config-file and -cache* flags.
+`
+
+// cacheCommand runs the 'cache' subcommand. args start with the command name and any
+// flags can follow it.
+func cacheCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		os.Exit(2)
+	}
+	command := args[0]
+	flag.CommandLine.Parse(args[1:])
+	args = flag.Args()
+
+	var config copycat.Config
+	if len(*configFile) > 0 {
+		config = readConfig(*configFile)
+	}
+	cache, err := copycat.OpenCache(cacheConfig(config.Cache), *dbFile)
+	errCheck(err, "Cache")
+	defer cache.Close()
+
+	switch {
+	case command == "stats":
+		stats, err := copycat.GetCacheStats(cache)
+		cacheCheck(err)
+		fmt.Printf("messages: %d\nbytes:    %d\n", stats.Count, stats.Bytes)
+		if stats.Count > 0 {
+			fmt.Printf("oldest:   %s\nnewest:   %s\n", stats.Oldest.Format(time.RFC1123Z), stats.Newest.Format(time.RFC1123Z))
+		}
+
+	case command == "list":
+		err = cache.Iterate(func(id string, data copycat.MessageData) error {
+			if (len(args) == 0) || strings.Contains(id, args[0]) {
+				fmt.Printf("%s\t%s\t%d\n", id, data.InternalDate.Format(time.RFC3339), len(data.Body))
+			}
+			return nil
+		})
+		cacheCheck(err)
+
+	case (command == "show") && (len(args) == 1):
+		data, err := cache.Get(args[0])
+		cacheCheck(err)
+		os.Stdout.Write(data.Body)
+
+	case (command == "dump") && (len(args) == 2):
+		data, err := cache.Get(args[0])
+		cacheCheck(err)
+		cacheCheck(ioutil.WriteFile(args[1], data.Body, 0600))
+
+	case (command == "delete") && (len(args) > 0):
+		for _, id := range args {
+			cacheCheck(cache.Delete(id))
+		}
+
+	case command == "verify":
+		var bad int
+		count, err := copycat.VerifyCache(cache, func(id string, err error) {
+			bad++
+			fmt.Printf("corrupt: %s: %s\n", id, err.Error())
+		})
+		cacheCheck(err)
+		fmt.Printf("checked %d messages, %d corrupt\n", count, bad)
+		if bad > 0 {
+			cache.Close()
+			os.Exit(1)
+		}
+
+	case (command == "prune") && (len(args) == 1):
+		age, err := time.ParseDuration(args[0])
+		errCheck(err, "Age")
+		pruned, err := copycat.PruneCache(cache, time.Now().Add(-age))
+		cacheCheck(err)
+		fmt.Printf("pruned %d messages\n", pruned)
+
+	case (command == "import") && (len(args) > 0):
+		if len(*identityName) == 0 {
+			*identityName = config.Identity
+		}
+		identity, err := copycat.NewIdentity(*identityName)
+		errCheck(err, "Identity")
+		for _, path := range args {
+			count, err := copycat.ImportMail(cache, identity, path)
+			cacheCheck(err)
+			fmt.Printf("imported %d messages from %s\n", count, path)
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, cacheUsage)
+		cache.Close()
+		os.Exit(2)
+	}
+}
+
+// cacheCheck will quit if a cache command fails.
+func cacheCheck(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cache error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,121 @@
+package copycat
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+)
+
+// validateAuth checks the InboxInfo's Auth mechanism and that it has what the mechanism needs.
+func (i *InboxInfo) validateAuth() error {
+	mech := strings.ToLower(i.Auth)
+	switch mech {
+	case "", "login", "plain", "cram-md5", "external":
+	default:
+		return errors.New("Unknown auth mechanism: " + i.Auth)
+	}
+
+	if (len(i.AuthzId) > 0) && (mech != "") && (mech != "plain") && (mech != "external") {
+		return errors.New("AuthzId needs the 'plain' or 'external' auth mechanism.")
+	}
+
+	if (i.OAuth == nil) && (mech != "external") && (len(i.Pw) == 0) {
+		return errors.New("Login Password is required.")
+	}
+	return nil
+}
+
+// authenticate will log in with the InboxInfo's Auth mechanism or, if it's not set,
+// the best one the server offers.
+func authenticate(conn Session, info InboxInfo) error {
+	if info.OAuth != nil {
+		return oauthLogin(conn, info)
+	}
+
+	mech := strings.ToLower(info.Auth)
+	if len(mech) == 0 {
+		var err error
+		if mech, err = bestAuth(conn.Caps(), info); err != nil {
+			return err
+		}
+		log.Printf("logging in to %s with %s", info.Host, strings.ToUpper(mech))
+	}
+
+	switch mech {
+	case "plain":
+		return conn.Authenticate(plainAuth(info.User, info.Pw, info.AuthzId))
+	case "cram-md5":
+		return conn.Authenticate(cramMD5Auth(info.User, info.Pw))
+	case "external":
+		return conn.Authenticate(externalAuth(info.AuthzId))
+	}
+	return conn.Login(info.User, info.Pw)
+}
+
+// bestAuth picks a mechanism from the server's capabilities. PLAIN is preferred, then
+// CRAM-MD5 and then LOGIN. Logging in as another user needs PLAIN.
+func bestAuth(caps map[string]bool, info InboxInfo) (string, error) {
+	if len(info.AuthzId) > 0 {
+		if !caps["AUTH=PLAIN"] {
+			return "", errors.New(info.Host + " doesn't support AUTH=PLAIN which is needed for an AuthzId")
+		}
+		return "plain", nil
+	}
+
+	switch {
+	case caps["AUTH=PLAIN"]:
+		return "plain", nil
+	case caps["AUTH=CRAM-MD5"]:
+		return "cram-md5", nil
+	case !caps["LOGINDISABLED"]:
+		return "login", nil
+	}
+	return "", errors.New(info.Host + " doesn't support any of the PLAIN, CRAM-MD5 or LOGIN mechanisms")
+}
+
+// saslResponse is a mechanism that only sends an initial response.
+type saslResponse struct {
+	mech     string
+	response string
+}
+
+func (a *saslResponse) Start() (string, []byte, error) {
+	return a.mech, []byte(a.response), nil
+}
+
+func (a *saslResponse) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("unexpected challenge from the server")
+}
+
+// plainAuth returns the RFC 4616 PLAIN mechanism.
+func plainAuth(user string, pw string, authzId string) SASL {
+	return &saslResponse{mech: "PLAIN", response: authzId + "\x00" + user + "\x00" + pw}
+}
+
+// externalAuth returns the RFC 4422 EXTERNAL mechanism.
+func externalAuth(authzId string) SASL {
+	return &saslResponse{mech: "EXTERNAL", response: authzId}
+}
+
+// cramMD5 is the RFC 2195 CRAM-MD5 mechanism.
+type cramMD5 struct {
+	user   string
+	secret string
+}
+
+func cramMD5Auth(user string, secret string) SASL {
+	return &cramMD5{user: user, secret: secret}
+}
+
+func (a *cramMD5) Start() (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(a.secret))
+	mac.Write(challenge)
+	return []byte(a.user + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
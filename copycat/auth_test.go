@@ -0,0 +1,34 @@
+package copycat
+
+import "testing"
+
+func TestBestAuth(t *testing.T) {
+	tests := []struct {
+		caps     map[string]bool
+		authzId  string
+		expected string
+	}{
+		{map[string]bool{"AUTH=PLAIN": true, "AUTH=CRAM-MD5": true}, "", "plain"},
+		{map[string]bool{"AUTH=CRAM-MD5": true}, "", "cram-md5"},
+		{map[string]bool{"IMAP4rev1": true}, "", "login"},
+		{map[string]bool{"AUTH=PLAIN": true}, "someone", "plain"},
+		{map[string]bool{"AUTH=CRAM-MD5": true}, "someone", ""},
+		{map[string]bool{"LOGINDISABLED": true}, "", ""},
+	}
+
+	for _, test := range tests {
+		mech, err := bestAuth(test.caps, InboxInfo{Host: "imap.example.com", AuthzId: test.authzId})
+		if (mech != test.expected) || ((err != nil) != (test.expected == "")) {
+			t.Errorf("bestAuth(%v, %q) returned %q (%v) - expected %q", test.caps, test.authzId, mech, err, test.expected)
+		}
+	}
+}
+
+func TestCramMD5(t *testing.T) {
+	// the example from RFC 2195
+	auth := cramMD5Auth("tim", "tanstaaftanstaaf")
+	response, _ := auth.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if expected := "tim b913a602c7eda7a495b4e6e7334d3890"; string(response) != expected {
+		t.Errorf("CRAM-MD5 responded with %q - expected %q", response, expected)
+	}
+}
@@ -0,0 +1,91 @@
+package copycat
+
+import "go.etcd.io/bbolt"
+
+var boltBucket = []byte("messages")
+
+// BoltCache is a MessageCache backed by a single bbolt file.
+type BoltCache struct {
+	db    *bbolt.DB
+	codec *valueCodec
+}
+
+func NewBoltCache(path string) (*BoltCache, error) {
+	db, err := bbolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltCache{db: db}, nil
+}
+
+func (c *BoltCache) Get(id string) (MessageData, error) {
+	var md MessageData
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		rawData := tx.Bucket(boltBucket).Get([]byte(id))
+		if rawData == nil {
+			return ErrNotFound
+		}
+		// rawData is only valid inside the transaction, decoding copies it out
+		return c.codec.decode(rawData, &md)
+	})
+	return md, err
+}
+
+func (c *BoltCache) Put(id string, data MessageData) error {
+	rawData, err := c.codec.encode(data)
+	if err != nil {
+		return err
+	}
+
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(id), rawData)
+	})
+}
+
+func (c *BoltCache) Delete(id string) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(id))
+	})
+}
+
+func (c *BoltCache) Iterate(fn func(id string, data MessageData) error) error {
+	return c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key, rawData []byte) error {
+			var md MessageData
+			if err := c.codec.decode(rawData, &md); err != nil {
+				return err
+			}
+			return fn(string(key), md)
+		})
+	})
+}
+
+// Verify will decode every message, passing any that can't be read to report.
+func (c *BoltCache) Verify(report func(id string, err error)) (int, error) {
+	var count int
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key, rawData []byte) error {
+			count++
+			var md MessageData
+			if err := c.codec.decode(rawData, &md); err != nil {
+				report(string(key), err)
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+func (c *BoltCache) Close() {
+	c.db.Close()
+}
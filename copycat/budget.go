@@ -0,0 +1,251 @@
+package copycat
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrBudgetExceeded = errors.New("daily bandwidth budget reached")
+
+// Budget counts the message bytes fetched from or appended to a single account on a Host
+// each day. Days go by local time. A Budget with no Limit only counts and a nil *Budget
+// is valid and will ignore any updates.
+type Budget struct {
+	Host  string
+	User  string
+	Limit int64
+
+	mu    sync.Mutex
+	day   string
+	used  int64
+	store *BudgetStore
+}
+
+// Allow will return ErrBudgetExceeded if transferring size more bytes would go past the limit.
+func (b *Budget) Allow(size int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	if (b.Limit > 0) && ((b.used >= b.Limit) || (b.used+int64(size) > b.Limit)) {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// Add will count size bytes against today's budget and save the new total.
+func (b *Budget) Add(size int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	under := b.used < b.Limit
+	b.used += int64(size)
+	if under && (b.Limit > 0) && (b.used >= b.Limit) {
+		log.Printf("%s on %s has used its daily bandwidth budget of %d bytes", b.User, b.Host, b.Limit)
+	}
+
+	if b.store != nil {
+		if err := b.store.Put(b.Host, b.User, b.day, b.used); err != nil {
+			log.Printf("Unable to save bandwidth usage for %s on %s: %s", b.User, b.Host, err.Error())
+		}
+	}
+}
+
+// Used returns the number of bytes transferred today.
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	return b.used
+}
+
+// roll will start counting from the saved total when the day changes.
+func (b *Budget) roll() {
+	today := budgetDay(time.Now())
+	if b.day == today {
+		return
+	}
+
+	b.day = today
+	b.used = 0
+	if b.store != nil {
+		var err error
+		if b.used, err = b.store.Get(b.Host, b.User, today); err != nil {
+			log.Printf("Unable to load bandwidth usage for %s on %s: %s", b.User, b.Host, err.Error())
+		}
+	}
+}
+
+func budgetDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// nextBudgetDay returns when the day after t starts.
+func nextBudgetDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+}
+
+// BudgetStore persists each account's daily usage alongside the Cache.
+type BudgetStore struct {
+	db *leveldb.DB
+}
+
+func NewBudgetStore(dbPath string) (*BudgetStore, error) {
+	db, err := leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BudgetStore{db: db}, nil
+}
+
+func (s *BudgetStore) Close() {
+	s.db.Close()
+}
+
+// Get returns the bytes used by the account on the host on the given day.
+func (s *BudgetStore) Get(host string, user string, day string) (int64, error) {
+	rawData, err := s.db.Get(budgetKey(host, user, day), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rawData) != 8 {
+		return 0, errors.New("bad bandwidth usage entry")
+	}
+	return int64(binary.BigEndian.Uint64(rawData)), nil
+}
+
+func (s *BudgetStore) Put(host string, user string, day string, used int64) error {
+	rawData := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawData, uint64(used))
+	return s.db.Put(budgetKey(host, user, day), rawData, nil)
+}
+
+func budgetKey(host string, user string, day string) []byte {
+	return []byte(host + "\x00" + user + "\x00" + day)
+}
+
+// budgetFile returns the location of the budget store for the given cache location.
+func budgetFile(dbFile string) string {
+	return dbFile + ".budget"
+}
+
+// budgets holds a Budget for each account on each host and knows which one each connection
+// belongs to so FetchMessage, AppendMessage and folder scans can count against it.
+var budgets = &budgetRegistry{
+	users: make(map[string]*Budget),
+	conns: make(map[Session]*Budget),
+}
+
+type budgetRegistry struct {
+	mu    sync.Mutex
+	users map[string]*Budget
+	conns map[Session]*Budget
+	store *BudgetStore
+}
+
+// track will count everything transferred on conn against the account's budget.
+func (r *budgetRegistry) track(conn Session, info InboxInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the same login on two servers is two accounts
+	host, _ := info.TLS.address(info.Host)
+	key := host + "\x00" + info.Account()
+	budget, ok := r.users[key]
+	if !ok {
+		budget = &Budget{Host: host, User: info.Account(), store: r.store}
+		r.users[key] = budget
+	}
+	budget.mu.Lock()
+	budget.Limit = info.DailyBudget
+	budget.mu.Unlock()
+	r.conns[conn] = budget
+}
+
+func (r *budgetRegistry) untrack(conn Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, conn)
+}
+
+// get returns the budget for the connection or nil if it isn't tracked.
+func (r *budgetRegistry) get(conn Session) *Budget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[conn]
+}
+
+// open will load and save usage in the budget store next to dbFile until the returned
+// func is called.
+func (r *budgetRegistry) open(dbFile string) (func(), error) {
+	store, err := NewBudgetStore(budgetFile(dbFile))
+	if err != nil {
+		return nil, err
+	}
+
+	r.setStore(store)
+	return func() {
+		r.setStore(nil)
+		store.Close()
+	}, nil
+}
+
+// setStore swaps the store for every budget and forces them to reload today's usage.
+func (r *budgetRegistry) setStore(store *BudgetStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = store
+	for _, budget := range r.users {
+		budget.mu.Lock()
+		budget.store = store
+		budget.day = ""
+		budget.mu.Unlock()
+	}
+}
+
+// countFetched will count the bodies and headers of messages fetched while scanning
+// a folder against the connection's budget.
+func countFetched(conn Session, msgs []*Message) {
+	var size int
+	for _, msg := range msgs {
+		size += len(msg.Body) + len(msg.Header)
+	}
+	if size > 0 {
+		budgets.get(conn).Add(size)
+	}
+}
+
+// checkBudgets will return ErrBudgetExceeded if any of the connections' accounts
+// have used up their budget.
+func checkBudgets(src []Session, dsts map[string][]Session) error {
+	conns := append([]Session{}, src...)
+	for _, dst := range dsts {
+		conns = append(conns, dst...)
+	}
+
+	for _, conn := range conns {
+		if err := budgets.get(conn).Allow(0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package copycat
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+const budgetTestLoc = "/tmp/budgettest"
+
+func TestBudget(t *testing.T) {
+	defer func() {
+		if err := os.RemoveAll(budgetTestLoc); err != nil {
+			log.Print(err.Error())
+		}
+	}()
+
+	store, err := NewBudgetStore(budgetTestLoc)
+	if err != nil {
+		t.Errorf("unable to create budget store - %s", err.Error())
+		return
+	}
+	defer store.Close()
+
+	budget := &Budget{Host: "imap.example.com", User: "user", Limit: 100, store: store}
+	if err = budget.Allow(60); err != nil {
+		t.Errorf("budget refused 60 of 100 bytes: %v", err)
+	}
+	budget.Add(60)
+	if err = budget.Allow(60); err != ErrBudgetExceeded {
+		t.Errorf("budget allowed 120 of 100 bytes: %v", err)
+	}
+
+	// a new budget for the same user picks up where the last left off
+	budget = &Budget{Host: "imap.example.com", User: "user", Limit: 100, store: store}
+	if budget.Used() != 60 {
+		t.Errorf("budget loaded %d bytes used - expected 60", budget.Used())
+	}
+	budget.Add(40)
+	if err = budget.Allow(0); err != ErrBudgetExceeded {
+		t.Errorf("budget wasn't used up after 100 of 100 bytes: %v", err)
+	}
+
+	// the same user on another host has its own budget
+	budget = &Budget{Host: "imap.example.org", User: "user", Limit: 100, store: store}
+	if budget.Used() != 0 {
+		t.Errorf("budget on another host loaded %d bytes used - expected 0", budget.Used())
+	}
+
+	// no limit only counts and nil does nothing
+	if err = (&Budget{User: "other"}).Allow(1000); err != nil {
+		t.Errorf("unlimited budget refused bytes: %v", err)
+	}
+	var none *Budget
+	none.Add(10)
+	if err = none.Allow(1000); err != nil {
+		t.Errorf("nil budget refused bytes: %v", err)
+	}
+}
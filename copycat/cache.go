@@ -4,22 +4,182 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
+// MessageCache holds the contents of messages we've pulled from the source by their
+// identity so they don't need to be downloaded again for each destination or sync.
+type MessageCache interface {
+	Get(id string) (MessageData, error)
+	Put(id string, data MessageData) error
+	// Delete evicts a message. Deleting a message that isn't cached is not an error.
+	Delete(id string) error
+	// Iterate calls fn for each cached message until fn returns an error. fn must not
+	// modify the cache.
+	Iterate(fn func(id string, data MessageData) error) error
+	Close()
+}
+
+// ErrIterateNotSupported is returned by caches that can't list their contents.
+var ErrIterateNotSupported = errors.New("cache does not support iterating")
+
+// CacheConfig picks the MessageCache backend.
+type CacheConfig struct {
+	// Type is 'leveldb' (the default), 'fs', 'bolt', 'memory' or 'memcache'.
+	Type string
+	// Path is where the leveldb, fs and bolt caches are kept. It defaults to the -db path.
+	Path string
+	// Servers are the memcached host:ports for the memcache cache.
+	Servers []string
+	// MaxItems is the number of messages the memory cache will hold before
+	// evicting the least recently used. It defaults to 1000.
+	MaxItems int
+	// Compression is 'none' (the default), 'gzip' or 'zstd'.
+	Compression string
+	// KeyFile or KeyEnv (the name of an environment variable) hold a hex or base64 encoded
+	// AES key. If either is set, cached messages are encrypted with AES-GCM.
+	KeyFile string
+	KeyEnv  string
+	// MaxBytes, MaxAge and AgeBy limit the leveldb cache. MaxAge is a duration like '720h'
+	// and AgeBy is either 'inserted' (the default) or 'internal-date'.
+	MaxBytes int64
+	MaxAge   string
+	AgeBy    string
+}
+
+func (c CacheConfig) Validate() error {
+	limits, err := c.Limits()
+	if err != nil {
+		return err
+	}
+	if ((limits.MaxBytes > 0) || (limits.MaxAge > 0)) && (c.Type != "") && (c.Type != "leveldb") {
+		return errors.New("Cache limits are only supported by the leveldb cache.")
+	}
+
+	key, err := readCacheKey(c.KeyFile, c.KeyEnv)
+	if err != nil {
+		return err
+	}
+	if _, err = newValueCodec(c.Compression, key); err != nil {
+		return err
+	}
+
+	switch c.Type {
+	case "", "leveldb", "fs", "bolt", "memory":
+		return nil
+	case "memcache":
+		if len(c.Servers) == 0 {
+			return errors.New("At least one memcached server is required.")
+		}
+		return nil
+	}
+	return errors.New("Unknown cache type: " + c.Type)
+}
+
+// Limits returns the leveldb cache's limits.
+func (c CacheConfig) Limits() (limits CacheLimits, err error) {
+	limits.MaxBytes = c.MaxBytes
+	if len(c.MaxAge) > 0 {
+		if limits.MaxAge, err = time.ParseDuration(c.MaxAge); err != nil {
+			return limits, errors.New("Invalid cache max age: " + err.Error())
+		}
+	}
+
+	switch c.AgeBy {
+	case "", "inserted":
+	case "internal-date":
+		limits.AgeByInternalDate = true
+	default:
+		return limits, errors.New("Unknown cache age: " + c.AgeBy)
+	}
+	return limits, nil
+}
+
+// OpenCache will open the cache described by the config. dbPath is used if the config has no path.
+func OpenCache(config CacheConfig, dbPath string) (MessageCache, error) {
+	path := config.Path
+	if len(path) == 0 {
+		path = dbPath
+	}
+
+	key, err := readCacheKey(config.KeyFile, config.KeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := newValueCodec(config.Compression, key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Type {
+	case "fs":
+		cache, err := NewFileCache(path)
+		if err == nil {
+			cache.codec = codec
+		}
+		return cache, err
+	case "bolt":
+		cache, err := NewBoltCache(path)
+		if err == nil {
+			cache.codec = codec
+		}
+		return cache, err
+	case "memory":
+		// nothing hits the disk so there's no need to encode anything
+		return NewMemoryCache(config.MaxItems), nil
+	case "memcache":
+		cache := NewMemcacheCache(config.Servers...)
+		cache.codec = codec
+		return cache, nil
+	}
+
+	limits, err := config.Limits()
+	if err != nil {
+		return nil, err
+	}
+	return openCache(path, limits, codec)
+}
+
+// Cache is a MessageCache backed by goleveldb. If it has limits, the size, age and last
+// access of each message are tracked alongside it so old and least recently used
+// messages can be evicted.
 type Cache struct {
-	db *leveldb.DB
+	db     *leveldb.DB
+	limits CacheLimits
+	codec  *valueCodec
+
+	// mu guards size and the tracking entries
+	mu   sync.Mutex
+	size int64
 }
 
 func NewCache(dbPath string) (*Cache, error) {
-	c := &Cache{}
+	return NewLimitedCache(dbPath, CacheLimits{})
+}
+
+// NewLimitedCache will open the leveldb cache at dbPath and evict messages to stay within the limits.
+func NewLimitedCache(dbPath string, limits CacheLimits) (*Cache, error) {
+	return openCache(dbPath, limits, nil)
+}
+
+func openCache(dbPath string, limits CacheLimits, codec *valueCodec) (*Cache, error) {
+	c := &Cache{limits: limits, codec: codec}
 	var err error
 	c.db, err = leveldb.OpenFile(dbPath, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.limited() {
+		if err = c.loadEntries(); err != nil {
+			c.db.Close()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -39,21 +199,73 @@ func (c *Cache) Get(id string) (MessageData, error) {
 		}
 		return md, err
 	}
-	err = deserialize(rawData, &md)
+	err = c.codec.decode(rawData, &md)
 	if err != nil {
 		return md, err
 	}
 
+	// expired messages are evicted and reported as missing
+	if c.limited() {
+		if err = c.touch(id); err != nil {
+			return MessageData{}, err
+		}
+	}
 	return md, nil
 }
 
 func (c *Cache) Put(id string, data MessageData) error {
-	rawData, err := serialize(data)
+	rawData, err := c.codec.encode(data)
 	if err != nil {
 		return err
 	}
 
-	return c.db.Put([]byte(id), rawData, nil)
+	if !c.limited() {
+		return c.db.Put([]byte(id), rawData, nil)
+	}
+	return c.putEntry(id, data, rawData)
+}
+
+func (c *Cache) Delete(id string) error {
+	if !c.limited() {
+		return c.db.Delete([]byte(id), nil)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deleteEntry(id)
+}
+
+// Iterate skips over the entries used to track limits.
+func (c *Cache) Iterate(fn func(id string, data MessageData) error) error {
+	iter := c.db.NewIterator(messageRange, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		var md MessageData
+		if err := c.codec.decode(iter.Value(), &md); err != nil {
+			return err
+		}
+		if err := fn(string(iter.Key()), md); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// Verify will decode every message, passing any that can't be read to report.
+func (c *Cache) Verify(report func(id string, err error)) (int, error) {
+	iter := c.db.NewIterator(messageRange, nil)
+	defer iter.Release()
+
+	var count int
+	for iter.Next() {
+		count++
+		var md MessageData
+		if err := c.codec.decode(iter.Value(), &md); err != nil {
+			report(string(iter.Key()), err)
+		}
+	}
+	return count, iter.Error()
 }
 
 // serialize encodes a value using gob.
@@ -1,8 +1,10 @@
 package copycat
 
 import (
+	"bytes"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -36,14 +38,231 @@ func TestCache(t *testing.T) {
 		return
 	}
 
-	if newData.InternalDate != data.InternalDate || len(newData.Body) != len(data.Body) {
+	if !newData.InternalDate.Equal(data.InternalDate) || len(newData.Body) != len(data.Body) {
 		t.Errorf("cache returned %v - expected %v", newData, data)
 		return
 	}
 
+	err = cache.Delete(key)
+	if err != nil {
+		t.Errorf("unable to delete from cache - %s", err.Error())
+		return
+	}
+
+	if _, err = cache.Get(key); err != ErrNotFound {
+		t.Errorf("cache returned %v after a delete - expected ErrNotFound", err)
+		return
+	}
+
 	log.Printf("cache result - %v - expected %v", newData, data)
 }
 
+func TestCacheBackends(t *testing.T) {
+	defer cleanUp()
+
+	for _, cacheType := range []string{"leveldb", "fs", "bolt", "memory"} {
+		cleanUp()
+		cache, err := OpenCache(CacheConfig{Type: cacheType}, cacheTestLoc)
+		if err != nil {
+			t.Errorf("unable to create %s cache - %s", cacheType, err.Error())
+			continue
+		}
+
+		for _, key := range []string{"<1@example.com>", "<2@example.com>"} {
+			if err = cache.Put(key, MessageData{Body: []byte(key)}); err != nil {
+				t.Errorf("unable to put in %s cache - %s", cacheType, err.Error())
+			}
+		}
+		if err = cache.Delete("<1@example.com>"); err != nil {
+			t.Errorf("unable to delete from %s cache - %s", cacheType, err.Error())
+		}
+		if err = cache.Delete("<missing@example.com>"); err != nil {
+			t.Errorf("%s cache returned %s deleting a missing message", cacheType, err.Error())
+		}
+		if _, err = cache.Get("<1@example.com>"); err != ErrNotFound {
+			t.Errorf("%s cache returned %v after a delete - expected ErrNotFound", cacheType, err)
+		}
+
+		found := make(map[string]string)
+		err = cache.Iterate(func(id string, data MessageData) error {
+			found[id] = string(data.Body)
+			return nil
+		})
+		if err != nil || len(found) != 1 || found["<2@example.com>"] != "<2@example.com>" {
+			t.Errorf("%s cache iterated over %v (%v) - expected only <2@example.com>", cacheType, found, err)
+		}
+		cache.Close()
+	}
+
+	// the memory cache should drop the least recently used message
+	cache := NewMemoryCache(2)
+	cache.Put("a", MessageData{})
+	cache.Put("b", MessageData{})
+	cache.Get("a")
+	cache.Put("c", MessageData{})
+	if _, err := cache.Get("b"); err != ErrNotFound {
+		t.Errorf("memory cache kept the least recently used message")
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	defer cleanUp()
+	cleanUp()
+
+	body := make([]byte, 1000)
+	cache, err := NewLimitedCache(cacheTestLoc, CacheLimits{MaxBytes: 4000, MaxAge: time.Hour, AgeByInternalDate: true})
+	if err != nil {
+		t.Errorf("unable to create cache - %s", err.Error())
+		return
+	}
+	defer cache.Close()
+
+	// a and c are used after b so b should be the first to go
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Put(key, MessageData{InternalDate: time.Now(), Body: body})
+	}
+	cache.Get("a")
+	cache.Get("c")
+	cache.Put("d", MessageData{InternalDate: time.Now(), Body: body})
+
+	for key, expected := range map[string]error{"a": nil, "b": ErrNotFound, "c": nil, "d": nil} {
+		if _, err = cache.Get(key); err != expected {
+			t.Errorf("cache returned %v for %s - expected %v", err, key, expected)
+		}
+	}
+
+	// old messages expire by their internal date
+	cache.Put("old", MessageData{InternalDate: time.Now().Add(-2 * time.Hour), Body: []byte("old")})
+	if _, err = cache.Get("old"); err != ErrNotFound {
+		t.Errorf("cache returned %v for an expired message - expected ErrNotFound", err)
+	}
+}
+
+func TestCacheCodec(t *testing.T) {
+	data := MessageData{InternalDate: time.Now(), Body: []byte("this is some confidential data"), Flags: []string{`\Seen`}}
+	key := make([]byte, 32)
+
+	// values written before the codec existed are plain gob
+	legacy, _ := serialize(data)
+	otherKey, _ := newValueCodec("", []byte("0123456789abcdef"))
+
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		for _, encrypt := range []bool{false, true} {
+			var codecKey []byte
+			if encrypt {
+				codecKey = key
+			}
+			codec, err := newValueCodec(compression, codecKey)
+			if err != nil {
+				t.Errorf("unable to create codec - %s", err.Error())
+				continue
+			}
+
+			rawData, err := codec.encode(data)
+			if err != nil {
+				t.Errorf("unable to encode with %s/%t - %s", compression, encrypt, err.Error())
+				continue
+			}
+			if encrypt && bytes.Contains(rawData, data.Body) {
+				t.Errorf("encrypted value holds the message body in cleartext")
+			}
+
+			for _, raw := range [][]byte{rawData, legacy} {
+				var decoded MessageData
+				if err = codec.decode(raw, &decoded); err != nil || string(decoded.Body) != string(data.Body) || len(decoded.Flags) != 1 {
+					t.Errorf("codec %s/%t decoded %v (%v) - expected %v", compression, encrypt, decoded, err, data)
+				}
+			}
+
+			if encrypt {
+				var decoded MessageData
+				if err = otherKey.decode(rawData, &decoded); err == nil {
+					t.Errorf("decoded an encrypted value with the wrong key")
+				}
+				if err = (*valueCodec)(nil).decode(rawData, &decoded); err != ErrNoCacheKey {
+					t.Errorf("decoding an encrypted value without a key returned %v - expected ErrNoCacheKey", err)
+				}
+			}
+		}
+	}
+}
+
+func TestCacheAdmin(t *testing.T) {
+	defer cleanUp()
+	cleanUp()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Errorf("unable to create cache - %s", err.Error())
+		return
+	}
+	defer cache.Close()
+
+	now := time.Now()
+	cache.Put("old", MessageData{InternalDate: now.Add(-48 * time.Hour), Body: []byte("old")})
+	cache.Put("new", MessageData{InternalDate: now, Body: []byte("newer")})
+	cache.db.Put([]byte("bad"), []byte("not a message"), nil)
+
+	var bad []string
+	count, err := VerifyCache(cache, func(id string, err error) { bad = append(bad, id) })
+	if err != nil || count != 3 || len(bad) != 1 || bad[0] != "bad" {
+		t.Errorf("verify checked %d (%v) and found %v - expected 3 and only 'bad'", count, err, bad)
+	}
+	cache.Delete("bad")
+
+	stats, err := GetCacheStats(cache)
+	if err != nil || stats.Count != 2 || stats.Bytes != 8 || !stats.Newest.Equal(now) {
+		t.Errorf("cache stats returned %v (%v) - expected 2 messages and 8 bytes", stats, err)
+	}
+
+	pruned, err := PruneCache(cache, now.Add(-24*time.Hour))
+	if _, getErr := cache.Get("old"); err != nil || pruned != 1 || getErr != ErrNotFound {
+		t.Errorf("prune removed %d messages (%v) - expected only 'old'", pruned, err)
+	}
+}
+
+func TestImportMbox(t *testing.T) {
+	mbox := "From alice@example.com Mon Jan  2 15:04:05 2006\n" +
+		"Message-Id: <one@example.com>\nSubject: one\n\nhello\n>From the start\n\n" +
+		"From bob@example.com Tue Jan  3 15:04:05 2006\n" +
+		"Message-Id: <two@example.com>\nSubject: two\n\nbye\n\n"
+
+	cache := NewMemoryCache(10)
+	count, err := ImportMbox(cache, MessageIdIdentity{}, strings.NewReader(mbox))
+	if err != nil || count != 2 {
+		t.Errorf("imported %d messages (%v) - expected 2", count, err)
+	}
+
+	data, err := cache.Get("<one@example.com>")
+	expected := "Message-Id: <one@example.com>\r\nSubject: one\r\n\r\nhello\r\nFrom the start\r\n"
+	if err != nil || string(data.Body) != expected {
+		t.Errorf("imported message was %q (%v) - expected %q", data.Body, err, expected)
+	}
+	if data.InternalDate.Day() != 2 {
+		t.Errorf("imported message has date %s - expected the 'From ' line's", data.InternalDate)
+	}
+	if _, err = cache.Get("<two@example.com>"); err != nil {
+		t.Errorf("second message wasn't imported: %v", err)
+	}
+
+	// a Takeout's extra headers shouldn't keep the messages from matching the server's copies
+	takeout := "From 1234567890@xxx Mon Jan 02 15:04:05 +0000 2006\n" +
+		"X-GM-THRID: 1234567890\nX-Gmail-Labels: Inbox,Important,\n Opened\n" +
+		"Date: Mon, 2 Jan 2006 15:04:05 +0000\nFrom: alice@example.com\nSubject: three\n\nhi\n\n"
+	server := []byte("Date: Mon, 2 Jan 2006 15:04:05 +0000\r\nFrom: alice@example.com\r\nSubject: three\r\n\r\nhi\r\n")
+	for _, identity := range []Identity{HeaderHashIdentity{}, BodyDigestIdentity{}} {
+		cache := NewMemoryCache(10)
+		if _, err = ImportMbox(cache, identity, strings.NewReader(takeout)); err != nil {
+			t.Errorf("unable to import takeout - %s", err.Error())
+			return
+		}
+		key, _ := identity.Key(server, uint32(len(server)), server)
+		if data, err := cache.Get(key); (err != nil) || !bytes.Equal(data.Body, server) {
+			t.Errorf("%T imported takeout message as %q (%v) - expected %q", identity, data.Body, err, server)
+		}
+	}
+}
+
 func cleanUp() {
 	err := os.RemoveAll(cacheTestLoc)
 	if err != nil {
@@ -0,0 +1,81 @@
+package copycat
+
+import (
+	"errors"
+	"time"
+)
+
+// CacheStats describes what's in a cache. Bytes only counts the message bodies and
+// Oldest/Newest go by each message's INTERNALDATE.
+type CacheStats struct {
+	Count  int
+	Bytes  int64
+	Oldest time.Time
+	Newest time.Time
+}
+
+// GetCacheStats will go through every message in the cache and add them up.
+func GetCacheStats(cache MessageCache) (stats CacheStats, err error) {
+	err = cache.Iterate(func(id string, data MessageData) error {
+		stats.Count++
+		stats.Bytes += int64(len(data.Body))
+		if stats.Oldest.IsZero() || data.InternalDate.Before(stats.Oldest) {
+			stats.Oldest = data.InternalDate
+		}
+		if data.InternalDate.After(stats.Newest) {
+			stats.Newest = data.InternalDate
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// PruneCache will delete every message that arrived before the given time and
+// return how many were deleted.
+func PruneCache(cache MessageCache, before time.Time) (int, error) {
+	// caches can't be modified while iterating so collect them first
+	var ids []string
+	err := cache.Iterate(func(id string, data MessageData) error {
+		if data.InternalDate.Before(before) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		if err = cache.Delete(id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// verifier is implemented by caches that can decode every entry without stopping at the first bad one.
+type verifier interface {
+	Verify(report func(id string, err error)) (int, error)
+}
+
+// VerifyCache will decode every message in the cache, passing any that can't be read
+// to report. It returns the number of messages checked. Caches that can't skip over bad
+// messages will stop at the first one.
+func VerifyCache(cache MessageCache, report func(id string, err error)) (int, error) {
+	if v, ok := cache.(verifier); ok {
+		return v.Verify(report)
+	}
+
+	var count int
+	err := cache.Iterate(func(id string, data MessageData) error {
+		count++
+		return nil
+	})
+	if err == ErrIterateNotSupported {
+		return count, err
+	}
+	if err != nil {
+		report("", errors.New("unable to read past a bad message: "+err.Error()))
+	}
+	return count, nil
+}
@@ -0,0 +1,275 @@
+package copycat
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// CompactMinutes is how often the cache is compacted while idling.
+const CompactMinutes = 60
+
+// CacheLimits keeps the leveldb Cache from growing forever. Zero values mean no limit.
+type CacheLimits struct {
+	// MaxBytes is the most message data to keep. The least recently used messages
+	// are evicted once it's passed.
+	MaxBytes int64
+	// MaxAge is how long to keep messages.
+	MaxAge time.Duration
+	// AgeByInternalDate ages messages by their INTERNALDATE instead of when they were cached.
+	AgeByInternalDate bool
+}
+
+// cacheEntry is what we track for each message in a limited Cache. Entries are kept under
+// entryPrefix+id, message ids never start with a NUL so they stay out of the way.
+type cacheEntry struct {
+	Size         int64
+	Inserted     time.Time
+	Accessed     time.Time
+	InternalDate time.Time
+}
+
+var entryPrefix = []byte{0, 'e'}
+
+// messageRange holds every key that isn't a tracking entry.
+var messageRange = &util.Range{Start: []byte{1}}
+
+func entryKey(id string) []byte {
+	return append(append([]byte{}, entryPrefix...), id...)
+}
+
+func (c *Cache) limited() bool {
+	return (c.limits.MaxBytes > 0) || (c.limits.MaxAge > 0)
+}
+
+func (c *Cache) expired(entry cacheEntry, now time.Time) bool {
+	if c.limits.MaxAge <= 0 {
+		return false
+	}
+
+	age := entry.Inserted
+	if c.limits.AgeByInternalDate && !entry.InternalDate.IsZero() {
+		age = entry.InternalDate
+	}
+	return now.Sub(age) > c.limits.MaxAge
+}
+
+// loadEntries adds up the size of the cache, tracking any messages that were
+// cached before the limits were turned on.
+func (c *Cache) loadEntries() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	iter := c.db.NewIterator(messageRange, nil)
+	defer iter.Release()
+
+	var tracked int
+	for iter.Next() {
+		entry, err := c.getEntry(string(iter.Key()))
+		if err == ErrNotFound {
+			var md MessageData
+			if err = c.codec.decode(iter.Value(), &md); err != nil {
+				return err
+			}
+			// with no idea when it was last used, it goes first
+			entry = cacheEntry{Size: int64(len(iter.Value())), Inserted: time.Now(), InternalDate: md.InternalDate}
+			if err = c.setEntry(string(iter.Key()), entry, nil); err != nil {
+				return err
+			}
+			tracked++
+		} else if err != nil {
+			return err
+		}
+		c.size += entry.Size
+	}
+	if tracked > 0 {
+		log.Printf("started tracking %d cached messages", tracked)
+	}
+	return iter.Error()
+}
+
+func (c *Cache) getEntry(id string) (cacheEntry, error) {
+	var entry cacheEntry
+	rawEntry, err := c.db.Get(entryKey(id), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return entry, ErrNotFound
+		}
+		return entry, err
+	}
+	err = deserialize(rawEntry, &entry)
+	return entry, err
+}
+
+// setEntry saves the entry, along with the message if rawData is set.
+func (c *Cache) setEntry(id string, entry cacheEntry, rawData []byte) error {
+	rawEntry, err := serialize(entry)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	if rawData != nil {
+		batch.Put([]byte(id), rawData)
+	}
+	batch.Put(entryKey(id), rawEntry)
+	return c.db.Write(batch, nil)
+}
+
+// touch marks the message as used. If it has expired it is evicted and ErrNotFound is returned.
+func (c *Cache) touch(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, err := c.getEntry(id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if c.expired(entry, now) {
+		if err = c.deleteEntry(id); err != nil {
+			return err
+		}
+		return ErrNotFound
+	}
+
+	entry.Accessed = now
+	return c.setEntry(id, entry, nil)
+}
+
+func (c *Cache) putEntry(id string, data MessageData, rawData []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, err := c.getEntry(id); err == nil {
+		c.size -= old.Size
+	}
+
+	now := time.Now()
+	entry := cacheEntry{Size: int64(len(rawData)), Inserted: now, Accessed: now, InternalDate: data.InternalDate}
+	if err := c.setEntry(id, entry, rawData); err != nil {
+		return err
+	}
+	c.size += entry.Size
+
+	if (c.limits.MaxBytes > 0) && (c.size > c.limits.MaxBytes) {
+		return c.evict()
+	}
+	return nil
+}
+
+// deleteEntry expects the lock to be held.
+func (c *Cache) deleteEntry(id string) error {
+	if entry, err := c.getEntry(id); err == nil {
+		c.size -= entry.Size
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(id))
+	batch.Delete(entryKey(id))
+	return c.db.Write(batch, nil)
+}
+
+type trackedEntry struct {
+	id    string
+	entry cacheEntry
+}
+
+type byAccessed []trackedEntry
+
+func (s byAccessed) Len() int           { return len(s) }
+func (s byAccessed) Less(i, j int) bool { return s[i].entry.Accessed.Before(s[j].entry.Accessed) }
+func (s byAccessed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// evict will remove any expired messages and then the least recently used until the cache
+// is back under 90% of MaxBytes, so we aren't evicting on every Put. It expects the lock to be held.
+func (c *Cache) evict() error {
+	var entries []trackedEntry
+	iter := c.db.NewIterator(util.BytesPrefix(entryPrefix), nil)
+	for iter.Next() {
+		var entry cacheEntry
+		if err := deserialize(iter.Value(), &entry); err != nil {
+			iter.Release()
+			return err
+		}
+		entries = append(entries, trackedEntry{id: string(iter.Key()[len(entryPrefix):]), entry: entry})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var expired, evicted int
+	var keep []trackedEntry
+	for _, tracked := range entries {
+		if !c.expired(tracked.entry, now) {
+			keep = append(keep, tracked)
+			continue
+		}
+		if err := c.deleteEntry(tracked.id); err != nil {
+			return err
+		}
+		expired++
+	}
+
+	if c.limits.MaxBytes > 0 {
+		sort.Sort(byAccessed(keep))
+		target := c.limits.MaxBytes / 10 * 9
+		for _, tracked := range keep {
+			if c.size <= target {
+				break
+			}
+			if err := c.deleteEntry(tracked.id); err != nil {
+				return err
+			}
+			evicted++
+		}
+	}
+
+	if (expired > 0) || (evicted > 0) {
+		log.Printf("cache evicted %d expired and %d least recently used messages. %d bytes cached", expired, evicted, c.size)
+	}
+	return nil
+}
+
+// Compact will evict anything over the limits and have leveldb reclaim the space.
+func (c *Cache) Compact() error {
+	if c.limited() {
+		c.mu.Lock()
+		err := c.evict()
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.db.CompactRange(util.Range{})
+}
+
+// compactor is implemented by caches that need to be cleaned up every so often.
+type compactor interface {
+	Compact() error
+}
+
+// compactCache will compact the cache every CompactMinutes until stop is closed.
+func compactCache(cache compactor, stop chan struct{}) {
+	ticker := time.NewTicker(CompactMinutes * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Print("compacting cache...")
+			if err := cache.Compact(); err != nil {
+				log.Printf("problems compacting cache: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package copycat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Cached values written by a valueCodec start with codecMarker and the format version so
+// they can be told apart from the plain gob values older caches hold. A gob stream never
+// starts with a zero byte.
+const (
+	codecMarker  = 0
+	codecVersion = 1
+)
+
+// bits of the flags byte that follows the version
+const (
+	codecGzip      = 1
+	codecZstd      = 2
+	codecEncrypted = 0x80
+
+	codecCompressionMask = 0x0f
+)
+
+var ErrNoCacheKey = errors.New("cache entry is encrypted but no key was given")
+
+// valueCodec optionally compresses and encrypts cached values. A nil valueCodec writes
+// plain gob but can still read compressed values.
+type valueCodec struct {
+	compression byte
+	aead        cipher.AEAD
+}
+
+// newValueCodec returns nil if there's nothing to do. compression is empty, 'none', 'gzip'
+// or 'zstd' and key is an AES-128, 192 or 256 key or nil to skip encryption.
+func newValueCodec(compression string, key []byte) (*valueCodec, error) {
+	codec := &valueCodec{}
+	switch compression {
+	case "", "none":
+	case "gzip":
+		codec.compression = codecGzip
+	case "zstd":
+		codec.compression = codecZstd
+	default:
+		return nil, errors.New("Unknown cache compression: " + compression)
+	}
+
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if codec.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	if (codec.compression == 0) && (codec.aead == nil) {
+		return nil, nil
+	}
+	return codec, nil
+}
+
+// readCacheKey loads a hex or base64 encoded key from keyFile or, if that's
+// empty, the keyEnv environment variable. No key is nil.
+func readCacheKey(keyFile string, keyEnv string) ([]byte, error) {
+	var encoded string
+	switch {
+	case len(keyFile) > 0:
+		raw, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(raw)
+	case len(keyEnv) > 0:
+		encoded = os.Getenv(keyEnv)
+		if len(encoded) == 0 {
+			return nil, errors.New("No cache key found in $" + keyEnv)
+		}
+	default:
+		return nil, nil
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if key, err := hex.DecodeString(encoded); err == nil {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("Cache key must be hex or base64 encoded.")
+}
+
+func (c *valueCodec) encode(src interface{}) ([]byte, error) {
+	rawData, err := serialize(src)
+	if (err != nil) || (c == nil) {
+		return rawData, err
+	}
+
+	flags := c.compression
+	switch c.compression {
+	case codecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(rawData); err != nil {
+			return nil, err
+		}
+		if err = zw.Close(); err != nil {
+			return nil, err
+		}
+		rawData = buf.Bytes()
+	case codecZstd:
+		rawData = zstdEncoder().EncodeAll(rawData, nil)
+	}
+
+	if c.aead != nil {
+		flags |= codecEncrypted
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		rawData = c.aead.Seal(nonce, nonce, rawData, []byte{codecMarker, codecVersion, flags})
+	}
+
+	return append([]byte{codecMarker, codecVersion, flags}, rawData...), nil
+}
+
+func (c *valueCodec) decode(src []byte, dst interface{}) error {
+	// values from before the codec existed are plain gob
+	if (len(src) == 0) || (src[0] != codecMarker) {
+		return deserialize(src, dst)
+	}
+
+	if (len(src) < 3) || (src[1] != codecVersion) {
+		return errors.New("unknown cache entry format")
+	}
+	header, flags, rawData := src[:3], src[2], src[3:]
+
+	if flags&codecEncrypted != 0 {
+		if (c == nil) || (c.aead == nil) {
+			return ErrNoCacheKey
+		}
+		if len(rawData) < c.aead.NonceSize() {
+			return errors.New("cache entry is too short")
+		}
+		nonce := rawData[:c.aead.NonceSize()]
+		var err error
+		if rawData, err = c.aead.Open(nil, nonce, rawData[len(nonce):], header); err != nil {
+			return err
+		}
+	}
+
+	switch flags & codecCompressionMask {
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(rawData))
+		if err != nil {
+			return err
+		}
+		if rawData, err = ioutil.ReadAll(zr); err != nil {
+			return err
+		}
+	case codecZstd:
+		var err error
+		if rawData, err = zstdDecoder().DecodeAll(rawData, nil); err != nil {
+			return err
+		}
+	}
+
+	return deserialize(rawData, dst)
+}
+
+// the zstd encoder and decoder are safe to share and spin up goroutines
+// so they're only created if they're needed.
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEnc, _ = zstd.NewWriter(nil)
+	zstdDec, _ = zstd.NewReader(nil)
+}
+
+func zstdEncoder() *zstd.Encoder {
+	zstdOnce.Do(initZstd)
+	return zstdEnc
+}
+
+func zstdDecoder() *zstd.Decoder {
+	zstdOnce.Do(initZstd)
+	return zstdDec
+}
@@ -0,0 +1,181 @@
+package copycat
+
+import (
+	"context"
+	"log"
+)
+
+// supportsCondStore returns true if the server supports CONDSTORE (RFC 7162).
+func supportsCondStore(conn Session) bool {
+	_, ok := unwrap(conn).(condStoreSession)
+	return ok && (conn.Caps()["CONDSTORE"] || conn.Caps()["QRESYNC"])
+}
+
+// supportsQResync returns true if the server supports QRESYNC (RFC 7162).
+func supportsQResync(conn Session) bool {
+	_, ok := unwrap(conn).(condStoreSession)
+	return ok && conn.Caps()["QRESYNC"]
+}
+
+// enableQResync will turn on QRESYNC if the server supports it. This has to be
+// done before a folder is selected.
+func enableQResync(conn Session) {
+	if !supportsQResync(conn) {
+		return
+	}
+
+	if err := unwrap(conn).(condStoreSession).Enable("QRESYNC"); err != nil {
+		log.Printf("Unable to enable QRESYNC: %s", err.Error())
+		return
+	}
+	trackQResync(conn)
+}
+
+// getHighestModSeq will grab the HIGHESTMODSEQ of the selected folder. If the
+// folder does not support mod-sequences, 0 is returned.
+func getHighestModSeq(conn Session) (uint64, error) {
+	mbox := conn.Selected()
+	if mbox == nil {
+		return 0, nil
+	}
+	return getFolderModSeq(conn, mbox.Name)
+}
+
+// getFolderModSeq will grab the HIGHESTMODSEQ of any folder. If the server or folder
+// does not support mod-sequences, 0 is returned.
+func getFolderModSeq(conn Session, folder string) (uint64, error) {
+	if !supportsCondStore(conn) {
+		return 0, nil
+	}
+	return unwrap(conn).(condStoreSession).HighestModSeq(folder)
+}
+
+// GetMessagesChangedSince will get the flags, UIDs and any extra FETCH items of all
+// messages that have been added or had their flags changed since the given mod-sequence.
+func GetMessagesChangedSince(conn Session, modSeq uint64, items ...string) ([]*Message, error) {
+	if mbox := conn.Selected(); (mbox != nil) && (mbox.Messages == 0) {
+		return nil, nil
+	}
+
+	cs, ok := unwrap(conn).(condStoreSession)
+	if !ok {
+		return nil, errUnsupported
+	}
+	return cs.FetchChangedSince(modSeq, items...)
+}
+
+// GetVanishedSince will use QRESYNC to find the UIDs of all messages that
+// have been expunged since the given mod-sequence.
+func GetVanishedSince(conn Session, modSeq uint64) (SeqSet, error) {
+	cs, ok := unwrap(conn).(condStoreSession)
+	if !ok {
+		return nil, errUnsupported
+	}
+	return cs.VanishedSince(modSeq)
+}
+
+// PurgeVanished will use QRESYNC to find the messages that have been expunged from the
+// source since the last purge and purge their copies from the destinations, following
+// each destination's policy, using the UIDs recorded in the sync state. Destinations that can't be handled this way (no
+// QRESYNC, no UIDPLUS or no previous purge) are run through SearchAndPurge instead.
+// If plan is not nil, the messages are recorded in it instead and the state is left alone.
+func PurgeVanished(ctx context.Context, src []Session, dsts map[string][]Session, policies map[string]PurgePolicy, cache MessageCache, dbFile string, identity Identity, plan *Plan) error {
+	stateStore, err := openStateStore(dbFile, plan)
+	if err != nil {
+		log.Printf("problems initiating sync state - %s", err.Error())
+		return err
+	}
+	defer stateStore.Close()
+
+	// grab the mod-sequence before looking at anything so nothing slips by
+	var highestModSeq uint64
+	if supportsQResync(src[0]) {
+		if highestModSeq, err = getHighestModSeq(src[0]); err != nil {
+			log.Printf("Unable to get HIGHESTMODSEQ: %s", err.Error())
+			highestModSeq = 0
+		}
+	}
+
+	srcMailbox := src[0].Selected()
+	fullPurge := make(map[string][]Session)
+	states := make(map[string]*FolderState)
+	var vanished SeqSet
+	var vanishedModSeq uint64
+	for user, dst := range dsts {
+		dstMailbox := dst[0].Selected()
+		key := stateKey(srcMailbox.Name, user, dstMailbox.Name)
+		var state *FolderState
+		if state, err = stateStore.Get(key); err != nil {
+			log.Printf("problems loading sync state for %s - %s", user, err.Error())
+			return err
+		}
+		state.CheckValidity(srcMailbox.UIDValidity, dstMailbox.UIDValidity)
+		states[key] = state
+
+		if (highestModSeq == 0) || (state.PurgedModSeq == 0) || !dst[0].Caps()["UIDPLUS"] {
+			fullPurge[user] = dst
+			continue
+		}
+
+		// only ask the source once, using the oldest mod-sequence we need
+		if (vanished == nil) || (state.PurgedModSeq < vanishedModSeq) {
+			vanishedModSeq = state.PurgedModSeq
+			if vanished, err = GetVanishedSince(src[0], vanishedModSeq); err != nil {
+				log.Printf("Unable to get vanished messages: %s", err.Error())
+				return err
+			}
+		}
+
+		if err = purgeUIDs(user, dst[0], policies[user], state, vanished, plan); err != nil {
+			log.Printf("Unable to purge vanished messages from %s: %s", user, err.Error())
+			return err
+		}
+	}
+
+	if len(fullPurge) > 0 {
+		if err = SearchAndPurge(ctx, src, fullPurge, policies, cache, identity, plan); err != nil {
+			return err
+		}
+	}
+
+	// save where we left off
+	for key, state := range states {
+		state.PurgedModSeq = highestModSeq
+		if err = stateStore.Put(key, state); err != nil {
+			log.Printf("Unable to save sync state: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// purgeUIDs will purge the destination copies of any vanished source messages. If plan
+// is not nil, they're recorded in it instead.
+func purgeUIDs(user string, conn Session, policy PurgePolicy, state *FolderState, vanished SeqSet, plan *Plan) error {
+	var dstUIDs SeqSet
+	var planned []PlannedMessage
+	for srcUID, dstUID := range state.UIDs {
+		if vanished.Contains(srcUID) {
+			dstUIDs.AddNum(dstUID)
+			planned = append(planned, PlannedMessage{UID: dstUID})
+			delete(state.UIDs, srcUID)
+		}
+	}
+
+	if dstUIDs.Empty() {
+		log.Printf("no vanished messages to purge for %s", user)
+		return nil
+	}
+	if plan != nil {
+		plan.addPurge(user, conn.Selected().Name, planned)
+		return nil
+	}
+
+	target, err := policy.prepare(conn)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("purging vanished messages from %s: %s", user, dstUIDs)
+	return policy.remove(conn, dstUIDs, target)
+}
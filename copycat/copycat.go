@@ -1,42 +1,71 @@
 package copycat
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"log"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
-
-	"code.google.com/p/go-imap/go1/imap"
 )
 
 const (
-	MemcacheServer = "localhost:11211"
-	NoopMinutes    = 15
+	NoopMinutes = 15
 )
 
 var NotFound = errors.New("message not found")
 
+// Options holds what a CopyCat needs to get going.
+type Options struct {
+	Source InboxInfo
+	Dest   []InboxInfo
+	// Folders picks the source folders to sync. Every folder is synced by default.
+	Folders FolderFilter
+	// Identity matches up messages between inboxes. It defaults to the MessageIdIdentity.
+	Identity Identity
+	Cache    CacheConfig
+	// ConnsPerInbox is the number of connections made to each inbox for syncing. It defaults to 2.
+	ConnsPerInbox int
+	// Sync and Idle say which connections to make.
+	Sync bool
+	Idle bool
+}
+
 // NewCopyCat will create a new CopyCat instance that has all of its expected connections for
 // syncing and idling.
-func NewCopyCat(src InboxInfo, dsts []InboxInfo, connsPerInbox int, sync bool, idle bool) (cat *CopyCat, err error) {
+func NewCopyCat(opts Options) (cat *CopyCat, err error) {
+	src, dsts := opts.Source, opts.Dest
+	if opts.Identity == nil {
+		opts.Identity = MessageIdIdentity{}
+	}
+	if opts.ConnsPerInbox <= 0 {
+		opts.ConnsPerInbox = 2
+	}
+
 	// pull user names for logging
 	var dstUsers []string
 	for _, usr := range dsts {
-		dstUsers = append(dstUsers, usr.User)
+		dstUsers = append(dstUsers, usr.Account())
 	}
-	log.Printf("Creating CopyCat to to sync %s's contents to the following mailbox(s):  %s", src.User, dstUsers)
+	log.Printf("Creating CopyCat to to sync %s's contents to the following mailbox(s):  %s", src.Account(), dstUsers)
+	setRateLimits(append([]InboxInfo{src}, dsts...)...)
 
-	cat = &CopyCat{}
-	if sync {
-		if cat.SyncConns, err = initiateConnections(src, dsts, connsPerInbox); err != nil {
+	cat = &CopyCat{Folders: opts.Folders, Identity: opts.Identity, Cache: opts.Cache, PurgePolicies: make(map[string]PurgePolicy)}
+	for _, dst := range dsts {
+		cat.PurgePolicies[dst.Account()] = dst.Purge
+	}
+	if opts.Sync {
+		if cat.SyncConns, err = initiateConnections(src, dsts, opts.ConnsPerInbox); err != nil {
 			log.Printf("unable to initiate sync connections: %s", err.Error())
 			return cat, err
 		}
-		log.Printf("created %d connections per inbox for syncing", connsPerInbox)
+		log.Printf("created %d connections per inbox for syncing", opts.ConnsPerInbox)
 	}
 
-	if idle {
+	if opts.Idle {
 		if cat.IdlePurgeConns, err = initiateConnections(src, dsts, 2); err != nil {
 			log.Printf("unable to initiate idle connections: %s", err.Error())
 			return cat, err
@@ -49,11 +78,14 @@ func NewCopyCat(src InboxInfo, dsts []InboxInfo, connsPerInbox int, sync bool, i
 		}
 		log.Print("created 1 connection per inbox for idling/appending")
 
-		if cat.IdleConn, err = GetConnection(src, true); err != nil {
+		if cat.IdleConns, cat.PollConn, cat.PolledFolders, err = initiateIdleConnections(src, opts.Folders); err != nil {
 			log.Printf("unable to initiate idle connections: %s", err.Error())
 			return cat, err
 		}
-		log.Print("created source 1 connection for idling")
+		log.Printf("created %d source connection(s) for idling, 1 per folder", len(cat.IdleConns))
+		if cat.PollConn != nil {
+			log.Printf("created 1 source connection for polling the other %d folder(s)", len(cat.PolledFolders))
+		}
 	}
 	return cat, nil
 }
@@ -63,35 +95,166 @@ type CopyCat struct {
 	SyncConns       conns
 	IdleAppendConns conns
 	IdlePurgeConns  conns
-	IdleConn        *imap.Client
+	// IdleConns holds a source connection for each folder being idled on.
+	IdleConns map[Folder]Session
+	// PollConn is shared by the PolledFolders, which are past MaxIdleConns.
+	PollConn      Session
+	PolledFolders []Folder
+	Folders       FolderFilter
+	Identity      Identity
+	Cache         CacheConfig
+	// PurgePolicies holds each destination's PurgePolicy by user.
+	PurgePolicies map[string]PurgePolicy
 }
 
-// Sync will make sure that the dst inbox looks exactly like the src.
-func (c *CopyCat) Sync(runPurge bool, dbFile string, quickSyncCount int) error {
-	return Sync(c.SyncConns.Source, c.SyncConns.Dest, runPurge, dbFile, quickSyncCount)
+// SyncOptions says how to run Sync, Plan and Idle. CopyCat's methods fill in the
+// Folders, Identity, Policies, Cache and Plan themselves.
+type SyncOptions struct {
+	// Folders picks the source folders to sync. Every folder is synced by default.
+	Folders FolderFilter
+	// Identity matches up messages between inboxes. It defaults to the MessageIdIdentity.
+	Identity Identity
+	// Purge will remove messages from each destination following its policy in Policies.
+	Purge    bool
+	Policies map[string]PurgePolicy
+	// Cache holds the messages pulled from the source.
+	Cache MessageCache
+	// DBFile is where the cache, sync state and bandwidth budgets are kept.
+	DBFile string
+	// QuickSyncCount only syncs the last QuickSyncCount messages of each folder. Idle ignores it.
+	QuickSyncCount int
+	// InitialSync makes Idle run a full sync once it starts.
+	InitialSync bool
+	// Plan turns Sync into a dry run that records its work in the Plan.
+	Plan *Plan
 }
 
-// Idle will optionally sync the mailboxes, wait for updates
+// syncOptions fills in everything the CopyCat knows about the sync.
+func (c *CopyCat) syncOptions(opts SyncOptions, cache MessageCache, plan *Plan) SyncOptions {
+	opts.Folders, opts.Identity, opts.Policies = c.Folders, c.Identity, c.PurgePolicies
+	opts.Cache, opts.Plan = cache, plan
+	return opts
+}
+
+// Sync will make sure that the dst inbox looks exactly like the src. It stops early
+// if ctx is done.
+func (c *CopyCat) Sync(ctx context.Context, opts SyncOptions) error {
+	cache, err := OpenCache(c.Cache, opts.DBFile)
+	if err != nil {
+		log.Printf("problems initiating cache - %s", err.Error())
+		return err
+	}
+	defer cache.Close()
+
+	closeBudgets, err := budgets.open(opts.DBFile)
+	if err != nil {
+		log.Printf("problems initiating bandwidth budgets - %s", err.Error())
+		return err
+	}
+	defer closeBudgets()
+
+	return Sync(ctx, c.SyncConns.Source, c.SyncConns.Dest, c.syncOptions(opts, cache, nil))
+}
+
+// Plan will work out what Sync would do without changing anything. The sync state
+// kept next to the DBFile is read to plan the same work the next sync would do.
+func (c *CopyCat) Plan(ctx context.Context, opts SyncOptions) (*Plan, error) {
+	plan := NewPlan()
+	err := Sync(ctx, c.SyncConns.Source, c.SyncConns.Dest, c.syncOptions(opts, nil, plan))
+	return plan, err
+}
+
+// Idle will sync the mailboxes if InitialSync is set, wait for updates
 // from the imap server and update the destinations appropriately.
-func (c *CopyCat) Idle(runSync bool, runPurge bool, dbFile string) (err error) {
+// Everything is shut down and ctx's error is returned once ctx is done.
+func (c *CopyCat) Idle(ctx context.Context, opts SyncOptions) (err error) {
+	// stop the sync and any other idles if one of the idles gives up
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	folders := append([]Folder{}, c.PolledFolders...)
+	for folder := range c.IdleConns {
+		folders = append(folders, folder)
+	}
 
-	purgeRequests := make(chan bool, 100)
+	// make sure every folder we are idling on has a home in the destinations.
+	var dstDelims map[string]string
+	if dstDelims, err = createDestFolders(c.IdleAppendConns.Dest, folders); err != nil {
+		log.Printf("Unable to create destination folders: %s", err.Error())
+		return
+	}
+
+	// the sync and purges share one cache
+	var cache MessageCache
+	if cache, err = OpenCache(c.Cache, opts.DBFile); err != nil {
+		log.Printf("problems initiating cache - %s", err.Error())
+		return
+	}
+	defer cache.Close()
+
+	var closeBudgets func()
+	if closeBudgets, err = budgets.open(opts.DBFile); err != nil {
+		log.Printf("problems initiating bandwidth budgets - %s", err.Error())
+		return
+	}
+	defer closeBudgets()
+
+	// everything below uses the cache and budgets so it all has to finish before they're closed
+	var workers sync.WaitGroup
+	defer workers.Wait()
+
+	// keep the cache within its limits while we wait around
+	if compactable, ok := cache.(compactor); ok {
+		stopCompacting := make(chan struct{})
+		defer close(stopCompacting)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			compactCache(compactable, stopCompacting)
+		}()
+	}
+
+	purgeRequests := make(chan Folder, 100)
 	// kick off sync as a goroutine if we plan on idling.
 	// Messages could come in/be deleted after sync makes its initial
 	// query against the source database. We want Idle to
 	// pick up those changes.
+	workers.Add(1)
 	go func() {
-		if runSync {
-			err = Sync(c.SyncConns.Source, c.SyncConns.Dest, runPurge, dbFile, 0)
-			if err != nil {
+		defer workers.Done()
+		if opts.InitialSync {
+			syncOpts := c.syncOptions(opts, cache, nil)
+			syncOpts.QuickSyncCount = 0
+			err := Sync(ctx, c.SyncConns.Source, c.SyncConns.Dest, syncOpts)
+			switch {
+			case err == ErrBudgetExceeded:
+				// pick the sync back up tomorrow without holding up the purges
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					c.resumeSync(ctx, syncOpts)
+				}()
+			case (err != nil) && (ctx.Err() == nil):
 				log.Print("SYNC ERROR: ", err.Error())
 			}
 		}
 
-		for _ = range purgeRequests {
-			err = SearchAndPurge(c.IdlePurgeConns.Source, c.IdlePurgeConns.Dest)
-			if err != nil {
-				log.Print("There was an error during the purge: (%s)", err.Error())
+		for folder := range purgeRequests {
+			// skip whatever is left once we're shutting down
+			if ctx.Err() != nil {
+				continue
+			}
+			if err := c.IdlePurgeConns.revive(ctx); err != nil {
+				log.Printf("Unable to reconnect for purge: (%s)", err.Error())
+				continue
+			}
+			if err := selectFolders(c.IdlePurgeConns, folder, dstDelims, false); err != nil {
+				log.Printf("Unable to select %s for purge: (%s)", folder.Name, err.Error())
+				continue
+			}
+
+			if err := SearchAndPurge(ctx, c.IdlePurgeConns.Source, c.IdlePurgeConns.Dest, c.PurgePolicies, cache, c.Identity, nil); err != nil {
+				log.Printf("There was an error during the purge: (%s)", err.Error())
 			}
 		}
 
@@ -102,62 +265,313 @@ func (c *CopyCat) Idle(runSync bool, runPurge bool, dbFile string) (err error) {
 	// setup storers for each destination
 	for _, dst := range c.IdleAppendConns.Dest {
 		storeRequests := make(chan WorkRequest)
+		index := newMessageIndex(c.Identity)
 		for _, dstConn := range dst {
 			storers.Add(1)
-			go CheckAndAppendMessages(dstConn, storeRequests, nil, &storers)
+			go CheckAndAppendMessages(ctx, dstConn, storeRequests, nil, nil, index, &storers)
 		}
 		appendRequests = append(appendRequests, storeRequests)
 	}
 
-	// idle...
-	err = Idle(c.IdleConn, appendRequests, purgeRequests)
-	if err != nil {
+	// idle on each folder, reconnecting and catching up if the connection drops...
+	idleErrs := make(chan error, len(c.IdleConns)+1)
+	var idlers sync.WaitGroup
+	for folder, conn := range c.IdleConns {
+		idlers.Add(1)
+		go func(conn Session, folder Folder) {
+			defer idlers.Done()
+			var nextUID uint32
+			for {
+				err := idleFolder(ctx, conn, folder, c.Identity, appendRequests, purgeRequests, &nextUID)
+				if ctx.Err() != nil {
+					idleErrs <- ctx.Err()
+					return
+				}
+				if (err == nil) && !isDead(conn) {
+					idleErrs <- nil
+					return
+				}
+
+				log.Printf("idle on %s stopped: %v. reconnecting...", folder.Name, err)
+				if conn, err = reconnect(ctx, conn); err != nil {
+					idleErrs <- err
+					return
+				}
+			}
+		}(conn, folder)
+	}
+
+	// poll whatever is left over the same way
+	if c.PollConn != nil {
+		idlers.Add(1)
+		go func(conn Session) {
+			defer idlers.Done()
+			last := make(map[string]*polledFolder)
+			for {
+				err := pollFolders(ctx, conn, c.PolledFolders, c.Identity, appendRequests, purgeRequests, last)
+				if ctx.Err() != nil {
+					idleErrs <- ctx.Err()
+					return
+				}
+
+				log.Printf("polling stopped: %v. reconnecting...", err)
+				if conn, err = reconnect(ctx, conn); err != nil {
+					idleErrs <- err
+					return
+				}
+			}
+		}(c.PollConn)
+	}
+
+	// ...and quit if any of them stop for good so the process can be restarted.
+	err = <-idleErrs
+	if (err != nil) && (err != context.Canceled) {
 		log.Print("IDLE ERROR: ", err.Error())
 	}
 
+	// once the idles are done nothing else is sent so the storers and purger can wind down
+	cancel()
+	idlers.Wait()
+	for _, requests := range appendRequests {
+		close(requests)
+	}
+	close(purgeRequests)
+	storers.Wait()
+
 	return
 }
 
-// Sync will make sure that the dst inbox looks exactly like the src.
-func Sync(src []*imap.Client, dsts map[string][]*imap.Client, runPurge bool, dbFile string, quickSyncCount int) (err error) {
-	log.Print("beginning sync...")
-
-	if runPurge {
-		err = SearchAndPurge(src, dsts)
-		if err != nil {
-			log.Print("There was an error during the purge. (%s) quitting process.", err.Error())
+// resumeSync will run the sync again each day until it stops running out of bandwidth
+// or ctx is done.
+func (c *CopyCat) resumeSync(ctx context.Context, opts SyncOptions) {
+	for {
+		next := nextBudgetDay(time.Now())
+		log.Printf("bandwidth budget reached. resuming the sync at %s", next.Format(time.RFC1123))
+		select {
+		case <-time.After(next.Sub(time.Now())):
+		case <-ctx.Done():
 			return
 		}
+
+		err := Sync(ctx, c.SyncConns.Source, c.SyncConns.Dest, opts)
+		if err == ErrBudgetExceeded {
+			continue
+		}
+		if (err != nil) && (ctx.Err() == nil) {
+			log.Print("SYNC ERROR: ", err.Error())
+		}
+		return
+	}
+}
+
+// Sync will make sure that the dst inbox looks exactly like the src. Each source folder
+// that matches the Folders filter will be created in the destinations if needed and then synced.
+// Messages are matched up between the inboxes with the Identity and purged from each
+// destination following its policy in Policies. Messages pulled from the source are
+// kept in the Cache and evicted when they're purged. If there's a Plan, this is a dry
+// run: everything is selected read-only, the sync state kept next to the DBFile is read but not
+// saved and the work that would be done is recorded in the Plan.
+// If an account runs out of its daily bandwidth budget, the sync stops and returns ErrBudgetExceeded.
+// If ctx is done, the sync stops after the work already handed out and returns ctx's error.
+// Otherwise, if any folder couldn't be stored, the rest are still synced and the first error is returned.
+func Sync(ctx context.Context, src []Session, dsts map[string][]Session, opts SyncOptions) (err error) {
+	if opts.Identity == nil {
+		opts.Identity = MessageIdIdentity{}
+	}
+	folders, identity, runPurge, policies := opts.Folders, opts.Identity, opts.Purge, opts.Policies
+	cache, dbFile, quickSyncCount, plan := opts.Cache, opts.DBFile, opts.QuickSyncCount, opts.Plan
+	if plan != nil {
+		log.Print("beginning dry run...")
 	} else {
-		log.Printf("skipping purge")
+		log.Print("beginning sync...")
+	}
+
+	syncConns := conns{Source: src, Dest: dsts}
+	if err = syncConns.revive(ctx); err != nil {
+		log.Printf("Unable to reconnect: (%s) quitting process.", err.Error())
+		return
+	}
+
+	var srcFolders []Folder
+	if srcFolders, err = ListFolders(src[0], folders); err != nil {
+		log.Printf("Unable to list source folders: (%s) quitting process.", err.Error())
+		return
 	}
 
-	err = SearchAndStore(src, dsts, dbFile, quickSyncCount)
+	var dstDelims map[string]string
+	if plan != nil {
+		dstDelims, err = planDestFolders(dsts, srcFolders, runPurge, policies, plan)
+	} else {
+		dstDelims, err = createDestFolders(dsts, srcFolders)
+	}
 	if err != nil {
-		log.Print("There was an error during the store. (%s) quitting process.", err.Error())
+		log.Printf("Unable to create destination folders: (%s) quitting process.", err.Error())
+		return
+	}
+
+	// if a connection drops partway through a folder, the folder is synced again once
+	// it's back. the sync state keeps that from redoing what was already done.
+	var retries int
+	var storeErr error
+	for i := 0; i < len(srcFolders); i++ {
+		folder := srcFolders[i]
+		retry := func() bool {
+			if !syncConns.dead() || (retries >= 3) {
+				return false
+			}
+			retries++
+			i--
+			log.Printf("lost a connection while syncing %s. trying it again.", folder.Name)
+			return true
+		}
+
+		if err = ctx.Err(); err != nil {
+			log.Printf("sync interrupted before %s", folder.Name)
+			return
+		}
+
+		if err = syncConns.revive(ctx); err != nil {
+			log.Printf("Unable to reconnect: (%s) quitting process.", err.Error())
+			return
+		}
+
+		if err = checkBudgets(src, dsts); err != nil {
+			log.Printf("Unable to sync folder %s: (%s) stopping sync.", folder.Name, err.Error())
+			return
+		}
+
+		// a dry run can't select the folders it would create so they're planned on their own
+		folderConns := syncConns
+		if plan != nil {
+			folderConns = planConns(syncConns, folder, dstDelims, plan)
+		}
+
+		log.Printf("syncing folder %s", folder.Name)
+		if err = selectFolders(folderConns, folder, dstDelims, plan != nil); err != nil {
+			if retry() {
+				continue
+			}
+			log.Printf("Unable to select folder %s: (%s) quitting process.", folder.Name, err.Error())
+			return
+		}
+
+		if plan != nil {
+			if err = planNewFolders(ctx, src[0], dsts, folder, dstDelims, identity, quickSyncCount, plan); err != nil {
+				if retry() {
+					continue
+				}
+				log.Printf("Unable to plan folder %s: (%s) quitting process.", folder.Name, err.Error())
+				return
+			}
+			if len(folderConns.Dest) == 0 {
+				continue
+			}
+		}
+
+		if runPurge {
+			err = PurgeVanished(ctx, src, folderConns.Dest, policies, cache, dbFile, identity, plan)
+			if err != nil {
+				if retry() {
+					continue
+				}
+				log.Printf("There was an error during the purge. (%s) quitting process.", err.Error())
+				return
+			}
+		} else {
+			log.Printf("skipping purge")
+		}
+
+		err = SearchAndStore(ctx, src, folderConns.Dest, cache, dbFile, quickSyncCount, identity, plan)
+		if retry() {
+			continue
+		}
+		if err != nil {
+			log.Printf("There was an error during the store of %s. (%s)", folder.Name, err.Error())
+			if storeErr == nil {
+				storeErr = err
+			}
+		}
+		retries = 0
+	}
+	if err = ctx.Err(); err != nil {
+		log.Print("sync interrupted")
+		return
+	}
+	// running out of bandwidth is why anything went unstored
+	if err = checkBudgets(src, dsts); err != nil {
+		log.Printf("sync stopped early: %s", err.Error())
+		return
+	}
+	if storeErr != nil {
+		log.Print("sync complete with errors")
+		return storeErr
+	}
+	if plan != nil {
+		log.Print("dry run complete")
+		return nil
 	}
 	log.Print("sync complete")
-	return
+	return nil
+}
+
+// createDestFolders will create the folders in each destination and return
+// each destination's hierarchy delimiter.
+func createDestFolders(dsts map[string][]Session, folders []Folder) (map[string]string, error) {
+	dstDelims := make(map[string]string)
+	for user, dst := range dsts {
+		delim, err := CreateFolders(dst[0], folders)
+		if err != nil {
+			log.Printf("Unable to create folders for %s: %s", user, err.Error())
+			return dstDelims, err
+		}
+		dstDelims[user] = delim
+	}
+	return dstDelims, nil
 }
 
 func (c *CopyCat) Close() {
 	c.SyncConns.Close()
 	c.IdleAppendConns.Close()
 	c.IdlePurgeConns.Close()
-	if c.IdleConn != nil {
-		c.IdleConn.Logout(20 * time.Second)
+	for _, conn := range c.IdleConns {
+		logout(current(conn))
+	}
+	if c.PollConn != nil {
+		logout(current(c.PollConn))
 	}
 }
 
 type Config struct {
-	Source InboxInfo
-	Dest   []InboxInfo
+	Source   InboxInfo
+	Dest     []InboxInfo
+	Folders  FolderFilter
+	Identity string
+	Cache    CacheConfig
 }
 
 type InboxInfo struct {
 	User string
 	Pw   string
 	Host string
+	// Auth is the login mechanism: 'login', 'plain', 'cram-md5' or 'external'. By default
+	// the best one the server supports is used.
+	Auth string
+	// AuthzId logs in as User (ie. a Dovecot master user) but acts as AuthzId.
+	AuthzId string
+	// Purge is only used for destinations.
+	Purge PurgePolicy
+	// DailyBudget is the most message data to fetch from or append to the
+	// account each day in bytes. No limit by default.
+	DailyBudget int64
+	// RateLimit throttles every connection to the inbox's host.
+	RateLimit RateLimit
+	// OAuth logs in with an OAuth2 token instead of Pw if it's set.
+	OAuth *OAuthConfig
+	// TLS sets how to connect to the Host.
+	TLS TLSConfig
+	// Client is the IMAP library to use: 'go1' (default, code.google.com/p/go-imap)
+	// or 'emersion' (github.com/emersion/go-imap).
+	Client string
 }
 
 func NewInboxInfo(id string, pw string, host string) (info InboxInfo, err error) {
@@ -170,123 +584,246 @@ func (i *InboxInfo) Validate() error {
 		return errors.New("Login ID is required.")
 	}
 
-	if len(i.Pw) == 0 {
-		return errors.New("Login Password is required.")
+	if i.OAuth != nil {
+		if err := i.OAuth.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := i.validateAuth(); err != nil {
+		return err
 	}
 
 	if len(i.Host) == 0 {
 		return errors.New("IMAP Host is required.")
 	}
 
+	if err := i.Purge.Validate(); err != nil {
+		return err
+	}
+
+	if i.DailyBudget < 0 {
+		return errors.New("Daily budget can't be negative.")
+	}
+
+	if err := i.RateLimit.Validate(); err != nil {
+		return err
+	}
+
+	if err := i.TLS.Validate(); err != nil {
+		return err
+	}
+
+	switch strings.ToLower(i.Client) {
+	case "", ClientGo1, ClientEmersion:
+	default:
+		return errors.New("Unknown IMAP client: " + i.Client)
+	}
+
 	return nil
 }
 
+// Account names the mailbox being synced. That's the AuthzId when logging
+// in as another user and the User otherwise.
+func (i InboxInfo) Account() string {
+	if len(i.AuthzId) > 0 {
+		return i.AuthzId
+	}
+	return i.User
+}
+
 type MessageData struct {
 	InternalDate time.Time
 	Body         []byte
+	Flags        []string
 }
 
-func FetchMessage(conn *imap.Client, messageUID uint32) (msg MessageData, err error) {
-	seq, _ := imap.NewSeqSet("")
-	seq.AddNum(messageUID)
-	var cmd *imap.Command
-	cmd, err = imap.Wait(conn.UIDFetch(seq, "INTERNALDATE", "BODY[]", "UID", "RFC822.HEADER"))
+// FetchMessage will pull a message from the source. The message is counted against the account's
+// daily budget and ErrBudgetExceeded is returned once it has been used up.
+func FetchMessage(conn Session, messageUID uint32) (msg MessageData, err error) {
+	budget := budgets.get(conn)
+	if err = budget.Allow(0); err != nil {
+		return
+	}
+
+	var msgs []*Message
+	msgs, err = conn.UIDFetch(NewSeqSet(messageUID), "INTERNALDATE", "BODY[]", "UID", "RFC822.HEADER", "FLAGS")
 	if err != nil {
 		log.Printf("Unable to fetch message (%d): %s", messageUID, err.Error())
 		return
 	}
 
-	if len(cmd.Data) == 0 {
+	if len(msgs) == 0 {
 		log.Printf("Unable to fetch message (%d) from src: NO DATA", messageUID)
 		return msg, NotFound
 	}
 
-	msgFields := cmd.Data[0].MessageInfo().Attrs
-	msg = MessageData{InternalDate: imap.AsDateTime(msgFields["INTERNALDATE"]), Body: imap.AsBytes(msgFields["BODY[]"])}
+	msg = MessageData{
+		InternalDate: msgs[0].InternalDate,
+		Body:         msgs[0].Body,
+		Flags:        copyableFlags(msgs[0].Flags),
+	}
+	budget.Add(len(msg.Body) + len(msgs[0].Header))
 	return msg, nil
 }
 
-func AppendMessage(conn *imap.Client, messageData MessageData) error {
-	_, err := imap.Wait(conn.Append("INBOX", imap.NewFlagSet("UnSeen"), &messageData.InternalDate, imap.NewLiteral(messageData.Body)))
-	return err
+// AppendMessage will add the message to the folder with the message's flags set. If the
+// server supports UIDPLUS, the UID of the new message is returned. Otherwise it will be 0.
+// ErrBudgetExceeded is returned if the message would go past the account's daily budget.
+func AppendMessage(conn Session, folder string, messageData MessageData) (uint32, error) {
+	budget := budgets.get(conn)
+	if err := budget.Allow(len(messageData.Body)); err != nil {
+		return 0, err
+	}
+
+	uid, err := conn.Append(folder, messageData.Flags, messageData.InternalDate, messageData.Body)
+	if err != nil {
+		return 0, err
+	}
+	budget.Add(len(messageData.Body))
+	return uid, nil
+}
+
+func AddDeletedFlag(conn Session, uid uint32) error {
+	return conn.StoreFlags(NewSeqSet(uid), true, `\Deleted`)
 }
 
-func AddDeletedFlag(conn *imap.Client, uid uint32) error {
-	seqSet, _ := imap.NewSeqSet("")
-	seqSet.AddNum(uid)
-	_, err := conn.UIDStore(seqSet, "+FLAGS", imap.NewFlagSet(`\Deleted`))
-	return err
+// GetAllMessages will get the headers, flags and UIDs of all messages along with any extra FETCH items.
+func GetAllMessages(conn Session, items ...string) ([]*Message, error) {
+	// some servers will complain about 1:* on an empty folder
+	if mbox := conn.Selected(); (mbox != nil) && (mbox.Messages == 0) {
+		return nil, nil
+	}
+
+	// get headers, flags and UID for ALL message in src inbox...
+	var allMsgs SeqSet
+	allMsgs.AddRange(1, 0)
+	return conn.Fetch(allMsgs, append([]string{"RFC822.HEADER", "UID", "FLAGS"}, items...)...)
+}
+
+func GetConnection(info InboxInfo, readOnly bool) (Session, error) {
+	conn, err := login(info)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.Select("INBOX", readOnly); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
 }
 
-func GetAllMessages(conn *imap.Client) (*imap.Command, error) {
-	// get headers and UID for ALL message in src inbox...
-	allMsgs, _ := imap.NewSeqSet("")
-	allMsgs.Add("1:*")
-	cmd, err := imap.Wait(conn.Fetch(allMsgs, "RFC822.HEADER", "UID"))
+// login will connect and authenticate without selecting a folder.
+func login(info InboxInfo) (Session, error) {
+	conn, err := dial(info)
 	if err != nil {
-		return &imap.Command{}, err
+		return nil, err
 	}
 
-	return cmd, nil
+	if err = authenticate(conn, info); err != nil {
+		return nil, err
+	}
+
+	supervised := &supervisedConn{Session: conn, info: info}
+	budgets.track(supervised, info)
+	return supervised, nil
+}
+
+// logout will close the connection and forget about it.
+func logout(conn Session) {
+	conn.Logout(20 * time.Second)
+	budgets.untrack(conn)
 }
 
-func GetConnection(info InboxInfo, readOnly bool) (*imap.Client, error) {
-	conn, err := imap.DialTLS(info.Host, new(tls.Config))
+// dial will connect to the inbox's host following its TLS settings and start a session
+// with the inbox's IMAP client. Commands are throttled by the host's RateLimit and so
+// are the bytes underneath any TLS.
+func dial(info InboxInfo) (Session, error) {
+	host, addr := info.TLS.address(info.Host)
+	config, err := info.TLS.config(host)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = conn.Login(info.User, info.Pw)
+	netConn, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		return nil, err
 	}
+	limiter := hostLimiter(info)
+	if (limiter != nil) && (limiter.bytes != nil) {
+		netConn = &limitedConn{Conn: netConn, limiter: limiter}
+	}
+	if info.TLS.mode() == "tls" {
+		netConn = tls.Client(netConn, config)
+	}
 
-	_, err = imap.Wait(conn.Select("INBOX", readOnly))
+	conn, err := newSession(info, netConn, host)
 	if err != nil {
 		return nil, err
 	}
+	if (limiter != nil) && (limiter.commands != nil) {
+		conn = limitSession(conn, limiter)
+	}
 
+	if info.TLS.mode() == "starttls" {
+		if !conn.Caps()["STARTTLS"] {
+			conn.Logout(dialTimeout)
+			return nil, errors.New(host + " doesn't support STARTTLS")
+		}
+		if err = conn.StartTLS(config); err != nil {
+			conn.Logout(dialTimeout)
+			return nil, err
+		}
+	}
 	return conn, nil
 }
 
-func ResetConnection(conn *imap.Client, readOnly bool) error {
-	// dont check for error because its possible it's already closed.
-	conn.Close(!readOnly)
+// dialTimeout is how long to wait for the server's greeting.
+const dialTimeout = 60 * time.Second
 
-	_, err := imap.Wait(conn.Select("INBOX", readOnly))
-	if err != nil {
-		return err
+// ResetConnection selects the connection's folder again. Selecting deselects the old
+// folder without expunging it, so messages someone else flagged as \Deleted are left alone.
+func ResetConnection(conn Session, readOnly bool) error {
+	folder := "INBOX"
+	if mbox := conn.Selected(); mbox != nil {
+		folder = mbox.Name
 	}
-
-	return nil
+	return conn.Select(folder, readOnly)
 }
 
 func initiateConnections(srcInfo InboxInfo, dstInfos []InboxInfo, connsPerInbox int) (conns conns, err error) {
 	//initiate connections
-	var srcConns []*imap.Client
-	dstConns := make(map[string][]*imap.Client)
+	var srcConns []Session
+	dstConns := make(map[string][]Session)
 	for i := 0; i < connsPerInbox; i++ {
-		// initiate source connections
-		var sourceConn *imap.Client
-		sourceConn, err = GetConnection(srcInfo, true)
+		// initiate source connections with QRESYNC turned on before selecting
+		var sourceConn Session
+		sourceConn, err = login(srcInfo)
 		if err != nil {
 			log.Printf("Unable to connect to %s: %s", srcInfo.User, err.Error())
 			return
 		}
 		srcConns = append(srcConns, sourceConn)
 
+		enableQResync(sourceConn)
+		if err = SelectFolder(sourceConn, "INBOX", true); err != nil {
+			log.Printf("Unable to select INBOX for %s: %s", srcInfo.User, err.Error())
+			return
+		}
+
 		// initiate destination connections
 		for _, dst := range dstInfos {
-			var dstConn *imap.Client
+			var dstConn Session
 			if dstConn, err = GetConnection(dst, false); err != nil {
-				log.Printf("Unable to connect to %s: %s", dst.User, err.Error())
+				log.Printf("Unable to connect to %s: %s", dst.Account(), err.Error())
 				return
 			}
 
-			if _, exists := dstConns[dst.User]; exists {
-				dstConns[dst.User] = append(dstConns[dst.User], dstConn)
+			if _, exists := dstConns[dst.Account()]; exists {
+				dstConns[dst.Account()] = append(dstConns[dst.Account()], dstConn)
 			} else {
-				dstConns[dst.User] = []*imap.Client{dstConn}
+				dstConns[dst.Account()] = []Session{dstConn}
 			}
 
 		}
@@ -297,26 +834,102 @@ func initiateConnections(srcInfo InboxInfo, dstInfos []InboxInfo, connsPerInbox
 	return conns, nil
 }
 
+// initiateIdleConnections will create a source connection for each folder that matches
+// the filter and select the folder on it. Only MaxIdleConns folders get one, INBOX first.
+// The rest are returned along with a connection to poll them on.
+func initiateIdleConnections(info InboxInfo, filter FolderFilter) (idleConns map[Folder]Session, pollConn Session, polled []Folder, err error) {
+	idleConns = make(map[Folder]Session)
+
+	var conn Session
+	if conn, err = GetConnection(info, true); err != nil {
+		log.Printf("Unable to connect to %s: %s", info.User, err.Error())
+		return
+	}
+	folders, err := ListFolders(conn, filter)
+	if err != nil {
+		conn.Logout(20 * time.Second)
+		log.Printf("Unable to list folders for %s: %s", info.User, err.Error())
+		return
+	}
+
+	// the INBOX is where new mail lands so it always gets an idle
+	sort.SliceStable(folders, func(i, j int) bool {
+		return strings.EqualFold(folders[i].Name, "INBOX") && !strings.EqualFold(folders[j].Name, "INBOX")
+	})
+	if len(folders) > MaxIdleConns {
+		// hang on to the connection we listed with for polling
+		folders, polled = folders[:MaxIdleConns], folders[MaxIdleConns:]
+		pollConn = conn
+	} else {
+		conn.Logout(20 * time.Second)
+	}
+
+	for _, folder := range folders {
+		if conn, err = GetConnection(info, true); err != nil {
+			log.Printf("Unable to connect to %s: %s", info.User, err.Error())
+			return
+		}
+		idleConns[folder] = conn
+
+		if err = SelectFolder(conn, folder.Name, true); err != nil {
+			log.Printf("Unable to select %s for %s: %s", folder.Name, info.User, err.Error())
+			return
+		}
+	}
+
+	return idleConns, pollConn, polled, nil
+}
+
+// WorkType tells the storers what to do with a WorkRequest.
+type WorkType int
+
+const (
+	// AppendWork will append the message to the destination if it doesn't exist.
+	AppendWork WorkType = iota
+	// FlagWork will only update the flags of the message if it exists in the destination.
+	FlagWork
+)
+
 type WorkRequest struct {
+	Type   WorkType
 	Value  string
 	Header string
 	UID    uint32
 	Msg    MessageData
+	// Missing is set when a diff has already found that the message
+	// does not exist in the destination so there's no need to search for it.
+	Missing bool
+	// Flags holds the source message's current flags. If set, storers will
+	// reconcile the flags of messages that already exist in the destination.
+	Flags []string
+	// Folder is the source folder the message belongs to. If set, storers will
+	// select the matching destination folder before handling the request.
+	Folder Folder
 }
 
 type conns struct {
-	Source []*imap.Client
-	Dest   map[string][]*imap.Client
+	Source []Session
+	Dest   map[string][]Session
 }
 
 func (c *conns) Close() {
 	for _, conn := range c.Source {
-		conn.Logout(20 * time.Second)
+		logout(current(conn))
 	}
 
 	for _, dst := range c.Dest {
 		for _, conn := range dst {
-			conn.Logout(20 * time.Second)
+			logout(current(conn))
 		}
 	}
 }
+
+// sortedUsers returns the destination users in order.
+func sortedUsers(dsts map[string][]Session) []string {
+	var users []string
+	for user := range dsts {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
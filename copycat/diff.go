@@ -0,0 +1,268 @@
+package copycat
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+)
+
+// ChunkSize is the number of messages fetched at a time while paging through a folder.
+var ChunkSize = 1000
+
+// scannedMessage is the bare minimum we need to know about a message to diff folders.
+type scannedMessage struct {
+	UID   uint32
+	Flags []string
+	// Key is the message's identity and Header is set if it can be searched for.
+	Key    string
+	Header string
+}
+
+func newScannedMessage(identity Identity, msg *Message) scannedMessage {
+	key, header := identify(identity, msg)
+	return scannedMessage{UID: msg.UID, Flags: copyableFlags(msg.Flags), Key: key, Header: header}
+}
+
+// scanResponses pulls the scanned messages out of a FETCH.
+func scanResponses(identity Identity, fetched []*Message) []scannedMessage {
+	var msgs []scannedMessage
+	for _, msg := range fetched {
+		msgs = append(msgs, newScannedMessage(identity, msg))
+	}
+	return msgs
+}
+
+// listUIDs will get the UIDs of every message in the selected folder greater than since, in order.
+func listUIDs(conn Session, since uint32) ([]uint32, error) {
+	// some servers will complain about searching an empty folder
+	if mbox := conn.Selected(); (mbox != nil) && (mbox.Messages == 0) {
+		return nil, nil
+	}
+
+	var criteria SearchCriteria
+	if since > 0 {
+		criteria.UIDs.AddRange(since+1, 0)
+	}
+	results, err := conn.Search(criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	// since+1:* will always match the last message, even if it is <= since.
+	var uids []uint32
+	for _, uid := range results {
+		if uid > since {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Sort(uidSlice(uids))
+	return uids, nil
+}
+
+type uidSlice []uint32
+
+func (s uidSlice) Len() int           { return len(s) }
+func (s uidSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uidSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// streamMessages will page through the given UIDs of the selected folder, fetching just
+// the UID, flags and identity of ChunkSize messages at a time and passing each one to msgs.
+// msgs is closed once every page has been sent so only a single page is held in memory.
+// If ctx is done, paging stops and its error is returned.
+func streamMessages(ctx context.Context, conn Session, identity Identity, uids []uint32, msgs chan<- scannedMessage) error {
+	defer close(msgs)
+
+	items := append([]string{"UID", "FLAGS"}, identity.FetchItems()...)
+	for start := 0; start < len(uids); start += ChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + ChunkSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		// the UIDs are in order so the page can go over the wire as a single range
+		var page SeqSet
+		page.AddRange(uids[start], uids[end-1])
+		fetched, err := conn.UIDFetch(page, items...)
+		if err != nil {
+			return err
+		}
+		countFetched(conn, fetched)
+		for _, msg := range fetched {
+			msgs <- newScannedMessage(identity, msg)
+		}
+	}
+	return nil
+}
+
+// scanMessages will start streaming the given UIDs of the selected folder in the background.
+// Once msgs is drained, the error from paging through the folder can be read from errs.
+func scanMessages(ctx context.Context, conn Session, identity Identity, uids []uint32) (msgs chan scannedMessage, errs chan error) {
+	msgs = make(chan scannedMessage, ChunkSize)
+	errs = make(chan error, 1)
+	go func() {
+		errs <- streamMessages(ctx, conn, identity, uids, msgs)
+	}()
+	return msgs, errs
+}
+
+// bufferMessages will read everything from msgs and hand it back on a new channel. This is
+// used when there's only a single connection and it can't page through the folder while
+// the workers are using it.
+func bufferMessages(msgs chan scannedMessage) chan scannedMessage {
+	var buffered []scannedMessage
+	for msg := range msgs {
+		buffered = append(buffered, msg)
+	}
+	return sendMessages(buffered)
+}
+
+// sendMessages puts the given messages on a closed channel.
+func sendMessages(msgs []scannedMessage) chan scannedMessage {
+	out := make(chan scannedMessage, len(msgs))
+	for _, msg := range msgs {
+		out <- msg
+	}
+	close(out)
+	return out
+}
+
+// folderIndex maps message identities to UIDs and UIDs to flags for a single folder.
+type folderIndex struct {
+	uids  map[string][]uint32
+	flags map[uint32][]string
+}
+
+func newFolderIndex() *folderIndex {
+	return &folderIndex{uids: make(map[string][]uint32), flags: make(map[uint32][]string)}
+}
+
+// Add puts a message in the index.
+func (f *folderIndex) Add(msg scannedMessage) {
+	f.uids[msg.Key] = append(f.uids[msg.Key], msg.UID)
+	f.flags[msg.UID] = msg.Flags
+}
+
+// Contains checks if the folder has any messages with the given key.
+func (f *folderIndex) Contains(key string) bool {
+	return len(f.uids[key]) > 0
+}
+
+// messageIndex holds a folderIndex for each folder of a mailbox. Each folder's
+// index is built the first time it is needed.
+type messageIndex struct {
+	identity Identity
+	mu       sync.Mutex
+	folders  map[string]*folderIndex
+}
+
+func newMessageIndex(identity Identity) *messageIndex {
+	return &messageIndex{identity: identity, folders: make(map[string]*folderIndex)}
+}
+
+// Build will scan the connection's selected folder if it hasn't been indexed yet.
+func (m *messageIndex) Build(ctx context.Context, conn Session) (*folderIndex, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	folder := conn.Selected().Name
+	if index, ok := m.folders[folder]; ok {
+		return index, nil
+	}
+
+	uids, err := listUIDs(conn, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the keys, UIDs and flags are kept as the folder is paged through
+	index := newFolderIndex()
+	msgs, errs := scanMessages(ctx, conn, m.identity, uids)
+	for msg := range msgs {
+		index.Add(msg)
+	}
+	if err = <-errs; err != nil {
+		return nil, err
+	}
+
+	log.Printf("indexed %d messages in %s", len(uids), folder)
+	m.folders[folder] = index
+	return index, nil
+}
+
+// Lookup will find the UIDs of all messages in the connection's selected folder with the given key.
+// Lookups come from the storers, which always finish the requests they've been handed.
+func (m *messageIndex) Lookup(conn Session, key string) ([]uint32, error) {
+	index, err := m.Build(context.Background(), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return index.uids[key], nil
+}
+
+// Add will put a newly appended message in the index if the folder has been indexed.
+func (m *messageIndex) Add(folder string, key string, uid uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if index, ok := m.folders[folder]; ok && (uid > 0) {
+		index.uids[key] = append(index.uids[key], uid)
+	}
+}
+
+// diff runs diffStore against one of the index's folders while holding the lock so
+// storers can keep adding to it.
+func (m *messageIndex) diff(msg scannedMessage, dst *folderIndex, state *FolderState) (WorkRequest, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return diffStore(msg, dst, state)
+}
+
+// findMessages will look for the message in the connection's selected folder. If the
+// message can be searched for by header, UID SEARCH is used. Otherwise the index is.
+func findMessages(conn Session, index *messageIndex, key string, searchHeader string) ([]uint32, error) {
+	if len(searchHeader) == 0 {
+		return index.Lookup(conn, key)
+	}
+
+	return conn.Search(SearchCriteria{Header: searchHeader, Value: key})
+}
+
+// diffStore compares a source message against a destination's index. If the message is
+// missing, an AppendWork request is returned. If it exists with different flags, a
+// FlagWork request is returned. Otherwise there is nothing to do and ok is false.
+func diffStore(msg scannedMessage, dst *folderIndex, state *FolderState) (request WorkRequest, ok bool) {
+	request = WorkRequest{Value: msg.Key, Header: msg.Header, UID: msg.UID, Flags: msg.Flags}
+
+	dstUIDs := dst.uids[msg.Key]
+	if len(dstUIDs) == 0 {
+		request.Missing = true
+		return request, true
+	}
+
+	state.Record(msg.UID, dstUIDs[0])
+	if flagsEqual(msg.Flags, dst.flags[dstUIDs[0]]) {
+		return request, false
+	}
+
+	request.Type = FlagWork
+	return request, true
+}
+
+// flagsEqual expects both flag lists to be sorted, as they are from copyableFlags.
+func flagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package copycat
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	src := indexMessages([]scannedMessage{
+		{UID: 1, Key: "<1@example.com>", Flags: []string{`\Seen`}},
+		{UID: 2, Key: "<2@example.com>", Flags: []string{`\Flagged`, `\Seen`}},
+		{UID: 3, Key: "<3@example.com>"},
+	})
+	dstMsgs := []scannedMessage{
+		{UID: 10, Key: "<1@example.com>", Flags: []string{`\Seen`}},
+		{UID: 11, Key: "<2@example.com>", Flags: []string{`\Seen`}},
+		{UID: 12, Key: "<gone@example.com>"},
+	}
+	dst := indexMessages(dstMsgs)
+	state := &FolderState{}
+
+	expected := map[uint32]struct {
+		ok       bool
+		workType WorkType
+		missing  bool
+	}{
+		1: {false, AppendWork, false},
+		2: {true, FlagWork, false},
+		3: {true, AppendWork, true},
+	}
+	for uid, key := range map[uint32]string{1: "<1@example.com>", 2: "<2@example.com>", 3: "<3@example.com>"} {
+		msg := scannedMessage{UID: uid, Key: key, Flags: src.flags[uid]}
+		request, ok := diffStore(msg, dst, state)
+		if ok != expected[uid].ok || (ok && (request.Type != expected[uid].workType || request.Missing != expected[uid].missing)) {
+			t.Errorf("diffStore(%d) returned %v/%t - expected %v", uid, request, ok, expected[uid])
+		}
+	}
+
+	if dstUID, ok := state.Lookup(2); !ok || dstUID != 11 {
+		t.Errorf("diffStore did not record UID 2 -> 11 in the state")
+	}
+
+	var extra []uint32
+	for msg := range sendMessages(dstMsgs) {
+		if !src.Contains(msg.Key) {
+			extra = append(extra, msg.UID)
+		}
+	}
+	if len(extra) != 1 || extra[0] != 12 {
+		t.Errorf("purge diff returned %v - expected only UID 12", extra)
+	}
+}
+
+func indexMessages(msgs []scannedMessage) *folderIndex {
+	index := newFolderIndex()
+	for _, msg := range msgs {
+		index.Add(msg)
+	}
+	return index
+}
@@ -0,0 +1,130 @@
+package copycat
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileCache is a MessageCache that keeps each message in its own file under a directory.
+// Files are named after a hash of the message's id and spread across 256 subdirectories.
+type FileCache struct {
+	dir   string
+	codec *valueCodec
+}
+
+// fileEntry is what's written to each file so the id can be recovered while iterating.
+type fileEntry struct {
+	Id   string
+	Data MessageData
+}
+
+func NewFileCache(dir string) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileCache{dir: dir}, nil
+}
+
+func (c *FileCache) Get(id string) (MessageData, error) {
+	var entry fileEntry
+	rawData, err := ioutil.ReadFile(c.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entry.Data, ErrNotFound
+		}
+		return entry.Data, err
+	}
+
+	err = c.codec.decode(rawData, &entry)
+	return entry.Data, err
+}
+
+func (c *FileCache) Put(id string, data MessageData) error {
+	rawData, err := c.codec.encode(fileEntry{Id: id, Data: data})
+	if err != nil {
+		return err
+	}
+
+	path := c.path(id)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// write to a temp file and rename it so readers never see a partial message
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(rawData); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *FileCache) Delete(id string) error {
+	err := os.Remove(c.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *FileCache) Iterate(fn func(id string, data MessageData) error) error {
+	return c.walk(func(path string, entry fileEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(entry.Id, entry.Data)
+	})
+}
+
+// Verify will decode every message, passing any that can't be read to report. Since the
+// id is inside the file, bad messages are reported by their path.
+func (c *FileCache) Verify(report func(id string, err error)) (int, error) {
+	var count int
+	err := c.walk(func(path string, entry fileEntry, err error) error {
+		count++
+		if err != nil {
+			report(path, err)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// walk will read each message file and pass it to fn along with any problems decoding it.
+func (c *FileCache) walk(fn func(path string, entry fileEntry, err error) error) error {
+	return filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		var entry fileEntry
+		rawData, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = c.codec.decode(rawData, &entry)
+		}
+		return fn(path, entry, err)
+	})
+}
+
+func (c *FileCache) Close() {}
+
+func (c *FileCache) path(id string) string {
+	hash := sha1.Sum([]byte(id))
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
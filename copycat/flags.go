@@ -0,0 +1,87 @@
+package copycat
+
+import (
+	"sort"
+	"strings"
+)
+
+// syncedFlags are the system flags that will be reproduced in the destinations.
+// Keywords (flags without a leading '\') are always reproduced.
+var syncedFlags = map[string]bool{
+	`\Seen`:     true,
+	`\Flagged`:  true,
+	`\Answered`: true,
+	`\Draft`:    true,
+}
+
+func isSyncedFlag(flag string) bool {
+	return syncedFlags[flag] || !strings.HasPrefix(flag, `\`)
+}
+
+// copyableFlags will filter out any flags that should not be copied to the
+// destinations like \Recent and \Deleted.
+func copyableFlags(flags []string) []string {
+	copyable := []string{}
+	for _, flag := range flags {
+		if isSyncedFlag(flag) {
+			copyable = append(copyable, flag)
+		}
+	}
+	sort.Strings(copyable)
+	return copyable
+}
+
+// diffFlags returns the flags that need to be added to and removed from the
+// destination's flags for them to match the source's.
+func diffFlags(src []string, dst []string) (add []string, remove []string) {
+	for _, flag := range src {
+		if !hasFlag(dst, flag) {
+			add = append(add, flag)
+		}
+	}
+
+	for _, flag := range copyableFlags(dst) {
+		if !hasFlag(src, flag) {
+			remove = append(remove, flag)
+		}
+	}
+	return add, remove
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncFlags will update the flags of the message in the destination so they
+// match the given source flags. Flags that are not synced are left alone.
+func SyncFlags(conn Session, uid uint32, flags []string) error {
+	seqSet := NewSeqSet(uid)
+	msgs, err := conn.UIDFetch(seqSet, "FLAGS")
+	if err != nil {
+		return err
+	}
+
+	if len(msgs) == 0 {
+		return NotFound
+	}
+
+	add, remove := diffFlags(flags, msgs[0].Flags)
+	if len(add) > 0 {
+		if err = conn.StoreFlags(seqSet, true, add...); err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		if err = conn.StoreFlags(seqSet, false, remove...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
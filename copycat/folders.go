@@ -0,0 +1,169 @@
+package copycat
+
+import (
+	"errors"
+	"log"
+	"path"
+	"strings"
+)
+
+// Folder represents a selectable mailbox in an inbox's folder tree.
+type Folder struct {
+	Name  string
+	Delim string
+}
+
+// Path returns the folder's name using the given hierarchy delimiter so
+// a folder can be recreated on servers that separate levels differently.
+func (f Folder) Path(delim string) string {
+	if len(f.Delim) == 0 || len(delim) == 0 || f.Delim == delim {
+		return f.Name
+	}
+	return strings.Replace(f.Name, f.Delim, delim, -1)
+}
+
+func (f Folder) isInbox() bool {
+	return strings.EqualFold(f.Name, "INBOX")
+}
+
+// FolderFilter decides which source folders will be synced. Patterns use
+// path.Match syntax against the folder name with '/' as the delimiter. A pattern
+// that matches a folder also matches all of its subfolders. An empty Include
+// list includes every folder.
+type FolderFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Validate will make sure all of the filter's patterns are well formed.
+func (f FolderFilter) Validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("Invalid folder pattern: " + pattern)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the folder should be synced.
+func (f FolderFilter) Match(folder Folder) bool {
+	name := folder.Path("/")
+	if (len(f.Include) > 0) && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+// matchAny checks the name and each of its parents against the patterns.
+func matchAny(patterns []string, name string) bool {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parent := strings.Join(parts[:i+1], "/")
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, parent); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ListFolders will use LIST to find all selectable folders in the inbox that
+// pass the given filter.
+func ListFolders(conn Session, filter FolderFilter) ([]Folder, error) {
+	infos, err := conn.List("", "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Folder
+	for _, info := range infos {
+		if info.Attrs[`\Noselect`] || info.Attrs[`\NonExistent`] {
+			continue
+		}
+
+		folder := Folder{Name: info.Name, Delim: info.Delim}
+		if filter.Match(folder) {
+			folders = append(folders, folder)
+		}
+	}
+
+	return folders, nil
+}
+
+// getDelimiter will ask the server for its hierarchy delimiter.
+func getDelimiter(conn Session) (string, error) {
+	infos, err := conn.List("", "")
+	if err != nil {
+		return "", err
+	}
+
+	if len(infos) > 0 {
+		return infos[0].Delim, nil
+	}
+
+	return "", errors.New("no delimiter returned!")
+}
+
+// CreateFolders will create any of the given folders that do not already exist in the
+// destination inbox. It returns the destination's hierarchy delimiter.
+func CreateFolders(conn Session, folders []Folder) (string, error) {
+	delim, err := getDelimiter(conn)
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := ListFolders(conn, FolderFilter{})
+	if err != nil {
+		return "", err
+	}
+	exists := make(map[string]bool)
+	for _, folder := range existing {
+		exists[folder.Name] = true
+	}
+
+	for _, folder := range folders {
+		name := folder.Path(delim)
+		if folder.isInbox() || exists[name] {
+			continue
+		}
+
+		log.Printf("creating missing folder: %s", name)
+		if err = conn.Create(name); err != nil {
+			return "", err
+		}
+		exists[name] = true
+	}
+
+	return delim, nil
+}
+
+// SelectFolder will select the folder on the connection if it isn't already selected.
+func SelectFolder(conn Session, folder string, readOnly bool) error {
+	if mbox := conn.Selected(); (mbox != nil) && (mbox.Name == folder) && (mbox.ReadOnly == readOnly) {
+		return nil
+	}
+
+	return conn.Select(folder, readOnly)
+}
+
+// selectFolders will select the given folder on all the source and destination
+// connections. dstDelims holds the hierarchy delimiter for each destination. The
+// source is always read-only and the destinations are too if readOnly is set.
+func selectFolders(c conns, folder Folder, dstDelims map[string]string, readOnly bool) error {
+	for _, conn := range c.Source {
+		if err := SelectFolder(conn, folder.Name, true); err != nil {
+			return err
+		}
+	}
+
+	for user, dst := range c.Dest {
+		for _, conn := range dst {
+			if err := SelectFolder(conn, folder.Path(dstDelims[user]), readOnly); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
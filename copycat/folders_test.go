@@ -0,0 +1,39 @@
+package copycat
+
+import "testing"
+
+func TestFolderFilter(t *testing.T) {
+	filter := FolderFilter{
+		Include: []string{"INBOX", "Work"},
+		Exclude: []string{"Work/Old*"},
+	}
+
+	tests := []struct {
+		folder   Folder
+		expected bool
+	}{
+		{Folder{Name: "INBOX", Delim: "/"}, true},
+		{Folder{Name: "Work", Delim: "."}, true},
+		{Folder{Name: "Work.Projects", Delim: "."}, true},
+		{Folder{Name: "Work/Old Projects", Delim: "/"}, false},
+		{Folder{Name: "Work/Old Projects/2012", Delim: "/"}, false},
+		{Folder{Name: "Personal", Delim: "/"}, false},
+	}
+
+	for _, test := range tests {
+		if got := filter.Match(test.folder); got != test.expected {
+			t.Errorf("filter.Match(%s) returned %t - expected %t", test.folder.Name, got, test.expected)
+		}
+	}
+
+	if !(FolderFilter{}).Match(Folder{Name: "Anything"}) {
+		t.Errorf("empty filter should match all folders")
+	}
+}
+
+func TestFolderPath(t *testing.T) {
+	folder := Folder{Name: "Work/Projects/2014", Delim: "/"}
+	if path := folder.Path("."); path != "Work.Projects.2014" {
+		t.Errorf("folder.Path returned %s - expected Work.Projects.2014", path)
+	}
+}
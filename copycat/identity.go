@@ -0,0 +1,106 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Identity decides how messages are matched up between the source and the destinations.
+// The key it returns is used to find messages in the destinations, to check if they still
+// exist in the source during a purge and to store them in the Cache.
+type Identity interface {
+	// FetchItems returns the FETCH items needed to build a key.
+	FetchItems() []string
+	// Key returns the identity of a message. If the key is a header value that can be
+	// found with UID SEARCH HEADER, the header's name is returned as well.
+	Key(header []byte, size uint32, body []byte) (key string, searchHeader string)
+}
+
+// NewIdentity returns the identity strategy with the given name. The options are
+// 'message-id' (the default), 'header-hash' and 'body-digest'.
+func NewIdentity(name string) (Identity, error) {
+	switch strings.ToLower(name) {
+	case "", "message-id":
+		return MessageIdIdentity{}, nil
+	case "header-hash":
+		return HeaderHashIdentity{}, nil
+	case "body-digest":
+		return BodyDigestIdentity{}, nil
+	}
+	return nil, errors.New("Unknown identity: " + name)
+}
+
+// MessageIdIdentity uses the Message-Id header. Messages without a Message-Id
+// fall back to the HeaderHashIdentity.
+type MessageIdIdentity struct{}
+
+func (MessageIdIdentity) FetchItems() []string {
+	return []string{"BODY.PEEK[HEADER.FIELDS (MESSAGE-ID DATE FROM SUBJECT)]", "RFC822.SIZE"}
+}
+
+func (MessageIdIdentity) Key(header []byte, size uint32, body []byte) (string, string) {
+	if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
+		if messageId := strings.TrimSpace(msg.Header.Get("Message-Id")); len(messageId) > 0 {
+			return messageId, "Message-Id"
+		}
+	}
+	return HeaderHashIdentity{}.Key(header, size, body)
+}
+
+// HeaderHashIdentity uses a hash of the normalized Date, From and Subject headers
+// along with the size of the message.
+type HeaderHashIdentity struct{}
+
+func (HeaderHashIdentity) FetchItems() []string {
+	return []string{"BODY.PEEK[HEADER.FIELDS (DATE FROM SUBJECT)]", "RFC822.SIZE"}
+}
+
+func (HeaderHashIdentity) Key(header []byte, size uint32, body []byte) (string, string) {
+	var date, from, subject string
+	if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
+		date = strings.TrimSpace(msg.Header.Get("Date"))
+		if parsed, err := msg.Header.Date(); err == nil {
+			date = parsed.UTC().Format(time.RFC3339)
+		}
+
+		from = strings.ToLower(strings.TrimSpace(msg.Header.Get("From")))
+		if addrs, err := msg.Header.AddressList("From"); (err == nil) && (len(addrs) > 0) {
+			from = strings.ToLower(addrs[0].Address)
+		}
+
+		subject = strings.Join(strings.Fields(msg.Header.Get("Subject")), " ")
+	}
+
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s\n%s\n%s\n%d", date, from, subject, size)))
+	return "hash:" + hex.EncodeToString(hash[:]), ""
+}
+
+// BodyDigestIdentity uses a digest of the full message. This requires downloading
+// every message to compare them so it should be used sparingly.
+type BodyDigestIdentity struct{}
+
+func (BodyDigestIdentity) FetchItems() []string {
+	return []string{"BODY.PEEK[]"}
+}
+
+func (BodyDigestIdentity) Key(header []byte, size uint32, body []byte) (string, string) {
+	digest := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(digest[:]), ""
+}
+
+// identify builds the identity of a message from a FETCH response.
+func identify(identity Identity, msg *Message) (string, string) {
+	return identity.Key(msg.Header, msg.Size, msg.Body)
+}
+
+// identifyData builds the identity of a message from its full contents.
+func identifyData(identity Identity, msg MessageData) (string, string) {
+	return identity.Key(msg.Body, uint32(len(msg.Body)), msg.Body)
+}
@@ -0,0 +1,31 @@
+package copycat
+
+import "testing"
+
+func TestMessageIdIdentity(t *testing.T) {
+	withId := []byte("Message-Id: <123@example.com>\r\nSubject: hi\r\n\r\nbody")
+	key, header := MessageIdIdentity{}.Key(withId, uint32(len(withId)), nil)
+	if key != "<123@example.com>" || header != "Message-Id" {
+		t.Errorf("identity returned %s/%s - expected <123@example.com>/Message-Id", key, header)
+	}
+
+	// messages without a Message-Id should fall back to a header hash that
+	// isn't thrown off by formatting differences between servers
+	noId := []byte("Date: Mon, 2 Jun 2014 10:00:00 -0400\r\nFrom: Someone <Someone@Example.com>\r\nSubject: a   subject\r\n\r\nbody")
+	sameMsg := []byte("Date: Mon, 02 Jun 2014 14:00:00 +0000\r\nFrom: someone@example.com\r\nSubject: a subject\r\n\r\nbody")
+
+	key, header = MessageIdIdentity{}.Key(noId, 100, nil)
+	if len(header) != 0 {
+		t.Errorf("identity without a Message-Id returned a search header: %s", header)
+	}
+
+	sameKey, _ := MessageIdIdentity{}.Key(sameMsg, 100, nil)
+	if key != sameKey {
+		t.Errorf("identity returned %s for the same message - expected %s", sameKey, key)
+	}
+
+	otherKey, _ := MessageIdIdentity{}.Key(sameMsg, 101, nil)
+	if key == otherKey {
+		t.Errorf("identity returned the same key for messages of different sizes")
+	}
+}
@@ -2,36 +2,79 @@ package copycat
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"log"
 	"net/mail"
-	"os"
-	"os/signal"
+	"strings"
 	"time"
-
-	"code.google.com/p/go-imap/go1/imap"
 )
 
 const idleTimeoutMinutes = 20
 
+// idlePoll is how long to wait between checks for updates during an idle.
+var idlePoll = 10 * time.Second
+
+// MaxIdleConns is the most folders that get an IDLE connection of their own. The rest
+// share a single connection that polls them every folderPoll.
+var MaxIdleConns = 5
+
+var folderPoll = time.Minute
+
 // Idle setup the processes to wait for notifications from the IMAP source connection.
+// The connection is expected to have the given folder selected.
 // If an EXISTS or EXPUNGE command comes across the pipe, the appropriate actions will be
-// taken to update the destinations. If the process decides the inboxes are out of sync,
-// it will pass a bool to the requestPurge channel. It is expected that the requestPurge
+// taken to update the destinations. FETCH notifications with new FLAGS are passed along
+// to the destinations as FlagWork requests. If the process decides the inboxes are out of sync,
+// it will pass the folder to the requestPurge channel. It is expected that the requestPurge
 // channel is setup to initiate a purge process when it receives the notificaiton.
-func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan bool) (err error) {
+// The idle is terminated and ctx's error is returned once ctx is done.
+func Idle(ctx context.Context, src Session, folder Folder, identity Identity, appendRequests []chan WorkRequest, requestPurge chan Folder) error {
 	var nextUID uint32
-	if nextUID, err = getNextUID(src); err != nil {
+	return idleFolder(ctx, src, folder, identity, appendRequests, requestPurge, &nextUID)
+}
+
+// idleFolder is Idle picking up where a previous idle left off. nextUID holds the next
+// UID the idle expects to see and is kept up to date. If it's set, anything that arrived
+// since is appended and a purge is requested to catch anything deleted in the meantime.
+// While idling, EXISTS brings in new messages as append requests, EXPUNGE or a shrinking
+// EXISTS requests a purge and a FETCH with FLAGS is passed along as a FlagWork request.
+func idleFolder(ctx context.Context, src Session, folder Folder, identity Identity, appendRequests []chan WorkRequest, requestPurge chan Folder, nextUID *uint32) (err error) {
+	var uidNext uint32
+	if uidNext, err = getNextUID(src, folder.Name); err != nil {
 		log.Printf("Unable to get UIDNext: %s", err.Error())
 		return err
 	}
 
-	// hold the size so we can determine how to react to commands
-	startSize := src.Mailbox.Messages
+	if *nextUID > 0 {
+		log.Printf("catching up on %s from UID %d...", folder.Name, *nextUID)
+		var missed []uint32
+		if missed, err = listUIDs(src, *nextUID-1); err != nil {
+			log.Printf("Unable to find missed messages: %s", err.Error())
+			return err
+		}
+		for _, uid := range missed {
+			if uid >= uidNext {
+				break
+			}
+			request, err := getMessageInfo(src, uid, identity)
+			if err != nil {
+				log.Printf("Unable to find message for UID (%d): %s", uid, err.Error())
+				continue
+			}
+			request.Folder = folder
+			if err = sendRequest(ctx, appendRequests, request); err != nil {
+				return err
+			}
+		}
+		if err = sendPurge(ctx, requestPurge, folder); err != nil {
+			return err
+		}
+	}
+	*nextUID = uidNext
 
-	// setup interrupt signal channel to terminate the idle
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill)
+	// hold the size so we can determine how to react to commands
+	startSize := src.Selected().Messages
 
 	// setup ticker to reset the idle every 20 minutes (RFC-2177 recommends 29 mins max)
 	timeout := time.NewTicker(idleTimeoutMinutes * time.Minute)
@@ -40,10 +83,9 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 	poll := make(chan bool, 1)
 	poll <- true
 
-	log.Print("beginning idle...")
-	_, idleErr := src.Idle()
-	if (idleErr != nil) && (idleErr != imap.ErrTimeout) {
-		log.Printf("Idle error: %s", idleErr.Error())
+	log.Printf("beginning idle on %s...", folder.Name)
+	if err = src.Idle(); err != nil {
+		log.Printf("Idle error: %s", err.Error())
 		return
 	}
 
@@ -53,87 +95,124 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 		// if we receive a 'poll' we should check the pipe for new messages
 		case <-poll:
 
-			err = src.Recv(0)
-			if (idleErr != nil) && (idleErr != imap.ErrTimeout) {
-				log.Printf("Idle error: %s", idleErr.Error())
-				go sleep(poll)
+			var updates []Update
+			if updates, err = src.Updates(); err != nil {
+				log.Printf("Idle error: %s", err.Error())
+				if src.Closed() {
+					return
+				}
+				go sleep(poll, idlePoll)
 				continue
 			}
 
-			// cache the data so we dont mess it up while start/stopping idle
-			var tempData []*imap.Response
-			tempData = append(tempData, src.Data...)
-			src.Data = nil
-			for _, data := range tempData {
-				switch data.Type {
-				case imap.Data:
-					// len of 2 likely means its an EXPUNGE or EXISTS command...
-					if len(data.Fields) == 2 {
-						msgNum := imap.AsNumber(data.Fields[0])
-
-						switch data.Fields[1] {
-						case "EXPUNGE":
-							log.Printf("Received an EXPUNGE notification requesting purge - %d", msgNum)
-							startSize = msgNum
-							requestPurge <- true
-
-						case "EXISTS":
-							log.Printf("Received an EXISTS notification - %d", msgNum)
-							if startSize > msgNum {
-								log.Printf("Mailbox decreased in size %d --> %d. Requesting a purge. MAILBOX MAY NEED TO SYNC", startSize, msgNum)
-								requestPurge <- true
-								startSize = msgNum
-								continue
-							}
+			var flagUpdates []*Message
+			for _, update := range updates {
+				msgNum := update.Num
+				switch update.Type {
+				case ExpungeUpdate:
+					log.Printf("Received an EXPUNGE notification requesting purge - %d", msgNum)
+					startSize = msgNum
+					if err = sendPurge(ctx, requestPurge, folder); err != nil {
+						src.IdleTerm()
+						return
+					}
 
-							// temporarily term the idle so we can fetch the message
-							if _, err = src.IdleTerm(); err != nil {
-								log.Printf("error while temporarily terminating idle: %s", err.Error())
-								return
-							}
-							log.Printf("terminated idle. appending message.")
-
-							newMessages := msgNum - startSize
-							log.Printf("attempting to find/append %d new messages", newMessages)
-							for i := uint32(0); i < newMessages; i++ {
-								var request WorkRequest
-								if request, err = getMessageInfo(src, nextUID); err == nil {
-
-									log.Printf("creating %d append requests for %d", len(appendRequests), nextUID)
-									for _, requests := range appendRequests {
-										requests <- request
-									}
-									log.Printf("done creating append requests for %d", nextUID)
-									nextUID++
-									startSize++
-								} else {
-									log.Printf("Unable to find message for UID (%d): %s", nextUID, err.Error())
-								}
-							}
+				case ExistsUpdate:
+					log.Printf("Received an EXISTS notification - %d", msgNum)
+					if startSize > msgNum {
+						log.Printf("Mailbox decreased in size %d --> %d. Requesting a purge. MAILBOX MAY NEED TO SYNC", startSize, msgNum)
+						if err = sendPurge(ctx, requestPurge, folder); err != nil {
+							src.IdleTerm()
+							return
+						}
+						startSize = msgNum
+						continue
+					}
+					if startSize == msgNum {
+						continue
+					}
+
+					// temporarily term the idle so we can fetch the message
+					if err = src.IdleTerm(); err != nil {
+						log.Printf("error while temporarily terminating idle: %s", err.Error())
+						return
+					}
+					log.Printf("terminated idle. appending message.")
+
+					newMessages := msgNum - startSize
+					log.Printf("attempting to find/append %d new messages", newMessages)
+					for i := uint32(0); i < newMessages; i++ {
+						var request WorkRequest
+						if request, err = getMessageInfo(src, *nextUID, identity); err == nil {
+							request.Folder = folder
 
-							log.Printf("continuing idle...")
-							// turn idle back on
-							if _, err = src.Idle(); err != nil {
-								log.Printf("Unable to restart idle: %s", err.Error())
+							log.Printf("creating %d append requests for %d", len(appendRequests), *nextUID)
+							if err = sendRequest(ctx, appendRequests, request); err != nil {
 								return
 							}
+							log.Printf("done creating append requests for %d", *nextUID)
+							(*nextUID)++
+							startSize++
+						} else {
+							log.Printf("Unable to find message for UID (%d): %s", *nextUID, err.Error())
 						}
 					}
+
+					log.Printf("continuing idle...")
+					// turn idle back on
+					if err = src.Idle(); err != nil {
+						log.Printf("Unable to restart idle: %s", err.Error())
+						return
+					}
+
+				case FlagsUpdate:
+					// a FETCH with FLAGS means a message's flags were changed by someone
+					log.Printf("Received a FETCH notification - %d", update.Message.Seq)
+					flagUpdates = append(flagUpdates, update.Message)
 				}
 			}
 
-			go sleep(poll)
+			if len(flagUpdates) > 0 {
+				// temporarily term the idle so we can look up the messages
+				if err = src.IdleTerm(); err != nil {
+					log.Printf("error while temporarily terminating idle: %s", err.Error())
+					return
+				}
+				log.Printf("terminated idle. updating flags for %d messages.", len(flagUpdates))
 
-		case <-interrupt:
-			log.Printf("Received interrupt. Terminating idle...")
-			_, err = src.IdleTerm()
-			if err != nil {
+				for _, msg := range flagUpdates {
+					var request WorkRequest
+					if request, err = getFlagUpdate(src, msg, identity); err != nil {
+						log.Printf("Unable to find message for flag update (%d): %s", msg.Seq, err.Error())
+						continue
+					}
+					request.Folder = folder
+
+					log.Printf("creating %d flag requests for %d", len(appendRequests), request.UID)
+					if err = sendRequest(ctx, appendRequests, request); err != nil {
+						return
+					}
+				}
+
+				log.Printf("continuing idle...")
+				// turn idle back on
+				if err = src.Idle(); err != nil {
+					log.Printf("Unable to restart idle: %s", err.Error())
+					return
+				}
+			}
+
+			go sleep(poll, idlePoll)
+
+		case <-ctx.Done():
+			log.Printf("Terminating idle on %s...", folder.Name)
+			if err = src.IdleTerm(); err != nil {
 				log.Printf("error while terminating idle: %s", err.Error())
 			}
-			return
+			return ctx.Err()
 		case <-timeout.C:
 			log.Printf("resetting idle...")
-			_, err = src.IdleTerm()
+			err = src.IdleTerm()
 			if err != nil {
 				log.Printf("error while temporarily terminating idle: %s", err.Error())
 				return
@@ -141,7 +220,7 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 			log.Printf("terminated idle.")
 
 			// turn idle back on
-			_, err = src.Idle()
+			err = src.Idle()
 			if err != nil {
 				log.Printf("Unable to restart idle: %s", err.Error())
 				return
@@ -149,11 +228,216 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 			log.Printf("idle restarted.")
 		}
 	}
+}
+
+// pollFolders stands in for an idle on the folders that didn't get a connection of their
+// own, checking each folder's STATUS on the shared connection every folderPoll. New messages
+// are passed along as append requests and flag changes as FlagWork requests. A purge is
+// requested if a folder lost any messages. last holds what each folder was last seen with
+// and is kept up to date so a reconnected poll can pick up where it left off.
+// ctx's error is returned once ctx is done.
+func pollFolders(ctx context.Context, conn Session, folders []Folder, identity Identity, appendRequests []chan WorkRequest, requestPurge chan Folder, last map[string]*polledFolder) error {
+	log.Printf("polling %d folders without an idle...", len(folders))
+	for {
+		for _, folder := range folders {
+			if err := pollFolder(ctx, conn, folder, identity, appendRequests, requestPurge, last); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-time.After(folderPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// polledFolder is what a folder looked like the last time it was polled.
+type polledFolder struct {
+	status *MailboxStatus
+	// modSeq is the folder's HIGHESTMODSEQ. It's 0 if the server doesn't support CONDSTORE.
+	modSeq uint64
+	// flags holds the copyable flags of every message by UID when there's no modSeq
+	// to tell which messages changed.
+	flags map[uint32]string
+}
+
+// pollFolder will compare the folder's STATUS with the last one seen and catch up on what changed.
+func pollFolder(ctx context.Context, conn Session, folder Folder, identity Identity, appendRequests []chan WorkRequest, requestPurge chan Folder, last map[string]*polledFolder) error {
+	status, err := conn.Status(folder.Name)
+	if err != nil {
+		log.Printf("Unable to get the status of %s: %s", folder.Name, err.Error())
+		return err
+	}
+	var modSeq uint64
+	if modSeq, err = getFolderModSeq(conn, folder.Name); err != nil {
+		log.Printf("Unable to get the mod-sequence of %s: %s", folder.Name, err.Error())
+		return err
+	}
+
+	prev, ok := last[folder.Name]
+	unchanged := ok && (prev.status.UIDNext == status.UIDNext) && (prev.status.Messages == status.Messages)
+	if unchanged && (modSeq > 0) && (prev.modSeq == modSeq) {
+		return nil
+	}
+
+	// select it again so the folder isn't stale
+	if err = conn.Select(folder.Name, true); err != nil {
+		log.Printf("Unable to select %s: %s", folder.Name, err.Error())
+		return err
+	}
+	current := &polledFolder{status: status, modSeq: modSeq}
+	if modSeq == 0 {
+		if current.flags, err = getFolderFlags(conn); err != nil {
+			log.Printf("Unable to get the flags in %s: %s", folder.Name, err.Error())
+			return err
+		}
+	}
+	if !ok {
+		last[folder.Name] = current
+		return nil
+	}
+
+	var added uint32
+	switch {
+	case status.UIDNext == prev.status.UIDNext:
+	case (prev.status.UIDNext == 0) || (status.UIDNext == 0):
+		// without UIDNEXT there's no telling which messages are new
+		log.Printf("%s didn't report its UIDNEXT. new messages wait for the next sync.", folder.Name)
+	default:
+		var uids []uint32
+		if uids, err = listUIDs(conn, prev.status.UIDNext-1); err != nil {
+			log.Printf("Unable to find new messages in %s: %s", folder.Name, err.Error())
+			return err
+		}
+		for _, uid := range uids {
+			if uid >= status.UIDNext {
+				break
+			}
+			request, err := getMessageInfo(conn, uid, identity)
+			if err != nil {
+				log.Printf("Unable to find message for UID (%d): %s", uid, err.Error())
+				continue
+			}
+			request.Folder = folder
+			if err = sendRequest(ctx, appendRequests, request); err != nil {
+				return err
+			}
+			added++
+		}
+	}
+
+	if err = pollFlags(ctx, conn, folder, identity, appendRequests, prev, current); err != nil {
+		return err
+	}
+
+	// fewer messages than expected means some were deleted
+	if status.Messages < prev.status.Messages+added {
+		log.Printf("%s lost messages since it was last polled. requesting a purge.", folder.Name)
+		if err = sendPurge(ctx, requestPurge, folder); err != nil {
+			return err
+		}
+	}
+	last[folder.Name] = current
+	return nil
+}
+
+// pollFlags will pass along a FlagWork request for each message that was already in the
+// folder when it was last polled and has had its flags changed since. The changes come from
+// CONDSTORE if the folder has a mod-sequence and from comparing the flags otherwise.
+func pollFlags(ctx context.Context, conn Session, folder Folder, identity Identity, appendRequests []chan WorkRequest, prev *polledFolder, current *polledFolder) error {
+	var changed []*Message
+	switch {
+	case (current.modSeq > 0) && (prev.modSeq > 0):
+		if current.modSeq == prev.modSeq {
+			return nil
+		}
+		msgs, err := GetMessagesChangedSince(conn, prev.modSeq, identity.FetchItems()...)
+		if err != nil {
+			log.Printf("Unable to find changed messages in %s: %s", folder.Name, err.Error())
+			return err
+		}
+		countFetched(conn, msgs)
+		changed = msgs
+	case (current.flags != nil) && (prev.flags != nil):
+		for uid, flags := range current.flags {
+			if was, ok := prev.flags[uid]; ok && (was != flags) {
+				changed = append(changed, &Message{UID: uid})
+			}
+		}
+	default:
+		// the server started or stopped reporting mod-sequences. pick up from here.
+		return nil
+	}
+
+	for _, msg := range changed {
+		if (msg.UID == 0) || (msg.UID >= prev.status.UIDNext) {
+			// new messages are appended with their flags
+			continue
+		}
+
+		var request WorkRequest
+		var err error
+		if current.modSeq > 0 {
+			request = newFlagWork(identity, msg)
+		} else if request, err = getFlagUpdate(conn, msg, identity); err != nil {
+			log.Printf("Unable to find message for flag update (%d): %s", msg.UID, err.Error())
+			continue
+		}
+		request.Folder = folder
+
+		log.Printf("creating %d flag requests for %d", len(appendRequests), request.UID)
+		if err = sendRequest(ctx, appendRequests, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFolderFlags returns the copyable flags of every message in the selected folder by UID.
+func getFolderFlags(conn Session) (map[uint32]string, error) {
+	flags := make(map[uint32]string)
+	// some servers will complain about 1:* on an empty folder
+	if mbox := conn.Selected(); (mbox != nil) && (mbox.Messages == 0) {
+		return flags, nil
+	}
+
+	var allMsgs SeqSet
+	allMsgs.AddRange(1, 0)
+	msgs, err := conn.Fetch(allMsgs, "UID", "FLAGS")
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		flags[msg.UID] = strings.Join(copyableFlags(msg.Flags), " ")
+	}
+	return flags, nil
+}
+
+// sendRequest will pass the request to each destination's storers unless ctx is done first.
+func sendRequest(ctx context.Context, appendRequests []chan WorkRequest, request WorkRequest) error {
+	for _, requests := range appendRequests {
+		select {
+		case requests <- request:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
 
-	return
+// sendPurge will ask for a purge of the folder unless ctx is done first.
+func sendPurge(ctx context.Context, requestPurge chan Folder, folder Folder) error {
+	select {
+	case requestPurge <- folder:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func getMessageInfo(conn *imap.Client, uid uint32) (WorkRequest, error) {
+func getMessageInfo(conn Session, uid uint32, identity Identity) (WorkRequest, error) {
 	log.Printf("fetching data for (%d) from src for idle", uid)
 
 	// get headers and UID for ALL message in src inbox...
@@ -164,9 +448,8 @@ func getMessageInfo(conn *imap.Client, uid uint32) (WorkRequest, error) {
 
 	var request WorkRequest
 	if mesg, _ := mail.ReadMessage(bytes.NewReader(msg.Body)); mesg != nil {
-		header := "Message-Id"
-		value := mesg.Header.Get(header)
-		request = WorkRequest{Value: value, Header: header, UID: uid, Msg: msg}
+		value, header := identifyData(identity, msg)
+		request = WorkRequest{Value: value, Header: header, UID: uid, Msg: msg, Flags: msg.Flags}
 	} else {
 		return request, errors.New("message was empty")
 	}
@@ -175,33 +458,53 @@ func getMessageInfo(conn *imap.Client, uid uint32) (WorkRequest, error) {
 	return request, nil
 }
 
-// getNextUID will grab the next message UID from the inbox. Client.Mailbox.UIDNext is cached so we can't use it.
-func getNextUID(conn *imap.Client) (uint32, error) {
-	cmd, err := imap.Wait(conn.Status("INBOX", "UIDNEXT"))
+// getFlagUpdate will build a FlagWork request with the message's current flags. Unsolicited
+// FETCH responses do not always include the UID so the message is looked up by its sequence number.
+func getFlagUpdate(conn Session, update *Message, identity Identity) (WorkRequest, error) {
+	items := append([]string{"UID", "FLAGS"}, identity.FetchItems()...)
+	var msgs []*Message
+	var err error
+	if update.UID > 0 {
+		msgs, err = conn.UIDFetch(NewSeqSet(update.UID), items...)
+	} else {
+		msgs, err = conn.Fetch(NewSeqSet(update.Seq), items...)
+	}
 	if err != nil {
-		return 0, err
+		return WorkRequest{}, err
 	}
+	countFetched(conn, msgs)
 
-	if len(cmd.Data) == 0 {
-		return 0, errors.New("no data returned!")
+	if len(msgs) == 0 {
+		return WorkRequest{}, NotFound
 	}
 
-	var status *imap.MailboxStatus
-	for _, resp := range cmd.Data {
-		switch resp.Type {
-		case imap.Data:
-			status = resp.MailboxStatus()
-			if status != nil {
-				break
-			}
-		}
+	return newFlagWork(identity, msgs[0]), nil
+}
+
+// newFlagWork builds a FlagWork request from a FETCH with the message's UID, flags and identity.
+func newFlagWork(identity Identity, msg *Message) WorkRequest {
+	value, header := identify(identity, msg)
+	return WorkRequest{
+		Type:   FlagWork,
+		Value:  value,
+		Header: header,
+		UID:    msg.UID,
+		Flags:  copyableFlags(msg.Flags),
+	}
+}
+
+// getNextUID will grab the next message UID from the folder. The selected folder's UIDNext is cached so we can't use it.
+func getNextUID(conn Session, folder string) (uint32, error) {
+	status, err := conn.Status(folder)
+	if err != nil {
+		return 0, err
 	}
 
 	return status.UIDNext, nil
 }
 
 // sleep is for sleeping. zZZzzZZzzZZzzz
-func sleep(poll chan bool) {
-	time.Sleep(10 * time.Second)
+func sleep(poll chan bool, wait time.Duration) {
+	time.Sleep(wait)
 	poll <- true
 }
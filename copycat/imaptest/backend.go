@@ -0,0 +1,448 @@
+package imaptest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Delimiter is the hierarchy delimiter of every mailbox.
+const Delimiter = "/"
+
+// memBackend keeps every user's mailboxes in memory. Unlike go-imap's memory backend it
+// is safe to use from several connections at once and it tells the server about new and
+// expunged messages so they're sent to clients that are idling. Updates wait in queue
+// until the Server hands them to go-imap on updates.
+type memBackend struct {
+	mu      sync.Mutex
+	users   map[string]*user
+	queue   chan backend.Update
+	updates chan backend.Update
+}
+
+func newBackend() *memBackend {
+	return &memBackend{
+		users:   make(map[string]*user),
+		queue:   make(chan backend.Update, 1000),
+		updates: make(chan backend.Update),
+	}
+}
+
+func (b *memBackend) Login(_ *imap.ConnInfo, username string, password string) (backend.User, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, ok := b.users[username]
+	if !ok || (u.password != password) {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+func (b *memBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+// notify will send an update to the connections with the mailbox selected. The caller
+// must hold the lock.
+func (b *memBackend) notify(update backend.Update) {
+	select {
+	case b.queue <- update:
+	default:
+		// nobody is listening
+	}
+}
+
+func (b *memBackend) notifyExists(mbox *mailbox) {
+	status := imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(mbox.messages))
+	b.notify(&backend.MailboxUpdate{Update: backend.NewUpdate(mbox.user.name, mbox.name), MailboxStatus: status})
+}
+
+// user must be called with the lock held.
+func (b *memBackend) user(name string) (*user, error) {
+	u, ok := b.users[name]
+	if !ok {
+		return nil, errors.New("No such user")
+	}
+	return u, nil
+}
+
+// mailbox must be called with the lock held.
+func (b *memBackend) mailbox(username string, name string) (*mailbox, error) {
+	u, err := b.user(username)
+	if err != nil {
+		return nil, err
+	}
+	mbox, ok := u.mailboxes[name]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+type user struct {
+	backend   *memBackend
+	name      string
+	password  string
+	mailboxes map[string]*mailbox
+	// nextValidity hands out a new UIDVALIDITY to each mailbox.
+	nextValidity uint32
+}
+
+func (u *user) Username() string {
+	return u.name
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	var names []string
+	for name := range u.mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mboxes []backend.Mailbox
+	for _, name := range names {
+		mboxes = append(mboxes, u.mailboxes[name])
+	}
+	return mboxes, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+	mbox, ok := u.mailboxes[name]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+	return u.createMailbox(name)
+}
+
+// createMailbox must be called with the lock held.
+func (u *user) createMailbox(name string) error {
+	if _, ok := u.mailboxes[name]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+	u.nextValidity++
+	u.mailboxes[name] = &mailbox{user: u, name: name, uidValidity: u.nextValidity, uidNext: 1}
+	return nil
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+	if name == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+	if _, ok := u.mailboxes[name]; !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	delete(u.mailboxes, name)
+	return nil
+}
+
+func (u *user) RenameMailbox(existingName string, newName string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+	mbox, ok := u.mailboxes[existingName]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	if _, ok := u.mailboxes[newName]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+	delete(u.mailboxes, existingName)
+	mbox.name = newName
+	u.mailboxes[newName] = mbox
+	if existingName == "INBOX" {
+		u.createMailbox("INBOX")
+	}
+	return nil
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+type mailbox struct {
+	user        *user
+	name        string
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*storedMessage
+}
+
+type storedMessage struct {
+	uid   uint32
+	date  time.Time
+	flags []string
+	body  []byte
+}
+
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: Delimiter, Name: m.name}, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	status.PermanentFlags = []string{`\*`}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = m.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = m.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			for _, msg := range m.messages {
+				if !hasFlag(msg.flags, imap.SeenFlag) {
+					status.Unseen++
+				}
+			}
+		}
+	}
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	// don't hold on to the lock while the messages are being written out
+	m.user.backend.mu.Lock()
+	var fetched []*imap.Message
+	for i, msg := range m.messages {
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(id(uid, seqNum, msg)) {
+			continue
+		}
+		if f, err := msg.fetch(seqNum, items); err == nil {
+			fetched = append(fetched, f)
+		}
+	}
+	m.user.backend.mu.Unlock()
+
+	for _, f := range fetched {
+		ch <- f
+	}
+	return nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+
+	var ids []uint32
+	for i, msg := range m.messages {
+		seqNum := uint32(i + 1)
+		entity, err := message.Read(bytes.NewReader(msg.body))
+		if err != nil {
+			continue
+		}
+		if ok, _ := backendutil.Match(entity, seqNum, msg.uid, msg.date, msg.flags, criteria); ok {
+			ids = append(ids, id(uid, seqNum, msg))
+		}
+	}
+	return ids, nil
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+	m.add(flags, date, data)
+	return nil
+}
+
+// add must be called with the lock held. It returns the new message's UID.
+func (m *mailbox) add(flags []string, date time.Time, body []byte) uint32 {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	msg := &storedMessage{uid: m.uidNext, date: date, flags: append([]string{}, flags...), body: body}
+	m.uidNext++
+	m.messages = append(m.messages, msg)
+	m.user.backend.notifyExists(m)
+	return msg.uid
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+
+	for i, msg := range m.messages {
+		if seqSet.Contains(id(uid, uint32(i+1), msg)) {
+			msg.flags = backendutil.UpdateFlags(msg.flags, op, flags)
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+
+	dest, ok := m.user.mailboxes[destName]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+
+	// copy them all before adding any in case it's the same mailbox
+	var copies []*storedMessage
+	for i, msg := range m.messages {
+		if seqSet.Contains(id(uid, uint32(i+1), msg)) {
+			copies = append(copies, msg)
+		}
+	}
+	for _, msg := range copies {
+		dest.add(msg.flags, msg.date, msg.body)
+	}
+	return nil
+}
+
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+
+	dest, ok := m.user.mailboxes[destName]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+
+	moved := make(map[*storedMessage]bool)
+	for i, msg := range m.messages {
+		if seqSet.Contains(id(uid, uint32(i+1), msg)) {
+			moved[msg] = true
+		}
+	}
+	// the deferred adds run in the messages' original order, before the unlock
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if msg := m.messages[i]; moved[msg] {
+			m.remove(i)
+			defer dest.add(msg.flags, msg.date, msg.body)
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) Expunge() error {
+	m.user.backend.mu.Lock()
+	defer m.user.backend.mu.Unlock()
+	m.expunge(nil)
+	return nil
+}
+
+// expunge removes the \Deleted messages whose UIDs are in uids, or all of them if uids
+// is nil. It must be called with the lock held.
+func (m *mailbox) expunge(uids *imap.SeqSet) {
+	// going backwards keeps the sequence numbers of the rest the same
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		msg := m.messages[i]
+		if !hasFlag(msg.flags, imap.DeletedFlag) || ((uids != nil) && !uids.Contains(msg.uid)) {
+			continue
+		}
+		m.remove(i)
+	}
+}
+
+// remove must be called with the lock held.
+func (m *mailbox) remove(i int) {
+	m.messages = append(m.messages[:i], m.messages[i+1:]...)
+	m.user.backend.notify(&backend.ExpungeUpdate{Update: backend.NewUpdate(m.user.name, m.name), SeqNum: uint32(i + 1)})
+}
+
+func (msg *storedMessage) fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header, _, _ := msg.headerAndBody()
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, _ := msg.headerAndBody()
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = append([]string{}, msg.flags...)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.date
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(msg.body))
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			header, body, err := msg.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Body[section], _ = backendutil.FetchBodySection(header, body, section)
+		}
+	}
+	return fetched, nil
+}
+
+func (msg *storedMessage) headerAndBody() (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(msg.body))
+	header, err := textproto.ReadHeader(body)
+	return header, body, err
+}
+
+// id returns the message's UID or sequence number.
+func id(uid bool, seqNum uint32, msg *storedMessage) uint32 {
+	if uid {
+		return msg.uid
+	}
+	return seqNum
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
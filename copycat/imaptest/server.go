@@ -0,0 +1,530 @@
+// Package imaptest runs an in-memory IMAP server on localhost for tests. Its users,
+// mailboxes, messages and capabilities can be set up by the test and it can be told
+// to drop connections, answer NO or be slow when it gets certain commands.
+package imaptest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+// Server is an IMAP server listening on localhost. It doesn't use TLS and allows
+// LOGIN and AUTHENTICATE PLAIN over the plain connection.
+type Server struct {
+	server   *server.Server
+	listener net.Listener
+	backend  *memBackend
+	// builtin has go-imap's own command handlers for the extension to wrap.
+	builtin *server.Server
+	// busy is held for reading by every command other than IDLE and for writing while
+	// an update is handed to go-imap. See dispatch.
+	busy   sync.RWMutex
+	closed chan struct{}
+
+	mu       sync.Mutex
+	caps     map[string]bool
+	faults   []*Fault
+	commands map[string]int
+}
+
+// Fault is something that goes wrong when the server gets a command.
+type Fault struct {
+	// Command is the command to fail, like 'FETCH'. UID commands match their plain
+	// names so a 'FETCH' fault hits 'UID FETCH' too.
+	Command string
+	// Times is how many times to fail the command. It fails every time if it's 0.
+	Times int
+	// Delay holds up the command before it's run, or before it fails.
+	Delay time.Duration
+	// Drop closes the connection instead of running the command.
+	Drop bool
+	// No answers NO with the message instead of running the command.
+	No string
+}
+
+// NewServer starts a server on a random port. It has no users until AddUser is called.
+// UIDPLUS is advertised along with everything go-imap's server supports.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		backend:  newBackend(),
+		builtin:  server.New(nil),
+		closed:   make(chan struct{}),
+		caps:     map[string]bool{"UIDPLUS": true},
+	}
+	s.server = server.New(s.backend)
+	s.server.AllowInsecureAuth = true
+	s.server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ext := &extension{s: s}
+	s.server.Enable(ext)
+	// enabling the extension looks up a few commands so start counting after
+	ext.enabled = true
+	s.commands = make(map[string]int)
+	go s.server.Serve(listener)
+	go s.dispatch()
+	return s, nil
+}
+
+// dispatch hands the backend's updates to go-imap one at a time. While sending an update,
+// go-imap reads every connection's user and selected mailbox, which its commands change
+// without any locking, so no command runs until it has looked through them all.
+func (s *Server) dispatch() {
+	for {
+		select {
+		case update := <-s.backend.queue:
+			s.busy.Lock()
+			s.backend.updates <- update
+			// go-imap only takes the next update once it's done with the connections
+			s.backend.updates <- &flush{backend.NewUpdate("", "")}
+			s.busy.Unlock()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// flush is an update that go-imap ignores.
+type flush struct {
+	backend.Update
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and drops every connection.
+func (s *Server) Close() error {
+	close(s.closed)
+	return s.server.Close()
+}
+
+// DropConnections will close every open connection without a word to the clients.
+func (s *Server) DropConnections() {
+	s.server.ForEachConn(func(conn server.Conn) {
+		conn.Close()
+	})
+}
+
+// SetCap advertises the capability if on is true and hides it otherwise. Hidden ones are
+// still left in the greeting so only the capabilities clients ask for after logging in
+// change. Hiding a capability doesn't turn it off, except for UIDPLUS: without it there's
+// no UID EXPUNGE or APPENDUID response code.
+func (s *Server) SetCap(name string, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caps[strings.ToUpper(name)] = on
+}
+
+func (s *Server) hasCap(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.caps[name]
+}
+
+// Inject will have the server fail the fault's command. Faults are checked in the order
+// they were added.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes every fault that hasn't run out.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// fault counts the command and returns its next fault, if any, counting it against its Times.
+func (s *Server) fault(command string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.commands != nil {
+		s.commands[command]++
+	}
+	for i, f := range s.faults {
+		if !strings.EqualFold(f.Command, command) {
+			continue
+		}
+		fault := *f
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &fault
+	}
+	return nil
+}
+
+// Count returns how many times the server has been sent the command. UID commands are
+// counted as both 'UID' and their plain names.
+func (s *Server) Count(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[strings.ToUpper(command)]
+}
+
+// AddUser creates a user with an empty INBOX.
+func (s *Server) AddUser(name string, password string) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	u := &user{backend: s.backend, name: name, password: password, mailboxes: make(map[string]*mailbox)}
+	u.createMailbox("INBOX")
+	s.backend.users[name] = u
+}
+
+// AddMailbox creates a mailbox for the user. Use Delimiter for sub-folders.
+func (s *Server) AddMailbox(username string, name string) error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	u, err := s.backend.user(username)
+	if err != nil {
+		return err
+	}
+	return u.createMailbox(name)
+}
+
+// AddMessage delivers a message to the mailbox and returns its UID. Connections with
+// the mailbox selected are sent an EXISTS.
+func (s *Server) AddMessage(username string, mailbox string, body string, flags ...string) (uint32, error) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	mbox, err := s.backend.mailbox(username, mailbox)
+	if err != nil {
+		return 0, err
+	}
+	return mbox.add(flags, time.Now(), []byte(body)), nil
+}
+
+// SetFlags replaces a message's flags. Connections with the mailbox selected are sent
+// a FETCH with the new flags.
+func (s *Server) SetFlags(username string, mailbox string, uid uint32, flags ...string) error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	mbox, err := s.backend.mailbox(username, mailbox)
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range mbox.messages {
+		if msg.uid != uid {
+			continue
+		}
+		msg.flags = append([]string{}, flags...)
+
+		update := imap.NewMessage(uint32(i+1), []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+		update.Flags = append([]string{}, flags...)
+		update.Uid = uid
+		s.backend.notify(&backend.MessageUpdate{Update: backend.NewUpdate(username, mailbox), Message: update})
+		return nil
+	}
+	return fmt.Errorf("no message with UID %d in %s", uid, mailbox)
+}
+
+// RemoveMessage expunges a message whether or not it's \Deleted. Connections with the
+// mailbox selected are sent an EXPUNGE.
+func (s *Server) RemoveMessage(username string, mailbox string, uid uint32) error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	mbox, err := s.backend.mailbox(username, mailbox)
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range mbox.messages {
+		if msg.uid == uid {
+			mbox.remove(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("no message with UID %d in %s", uid, mailbox)
+}
+
+// Message is a message in one of the server's mailboxes.
+type Message struct {
+	UID   uint32
+	Flags []string
+	Date  time.Time
+	Body  []byte
+}
+
+// Messages returns the messages in the mailbox in order.
+func (s *Server) Messages(username string, mailbox string) ([]Message, error) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	mbox, err := s.backend.mailbox(username, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Message, len(mbox.messages))
+	for i, msg := range mbox.messages {
+		msgs[i] = Message{UID: msg.uid, Flags: append([]string{}, msg.flags...), Date: msg.date, Body: msg.body}
+	}
+	return msgs, nil
+}
+
+// NewMessage builds a small message with the given Message-ID and subject.
+func NewMessage(messageId string, subject string) string {
+	return "From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+		"Message-ID: " + messageId + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		subject + "\r\n"
+}
+
+// extension hooks the Server's capabilities, UIDPLUS and faults into go-imap's server.
+type extension struct {
+	s *Server
+	// enabled is false while go-imap checks the extension. It skips any extension with
+	// its own UNSELECT, MOVE or IDLE.
+	enabled bool
+}
+
+// Capabilities lists the ones that have been turned on with SetCap.
+func (e *extension) Capabilities(c server.Conn) []string {
+	e.s.mu.Lock()
+	defer e.s.mu.Unlock()
+	var caps []string
+	for name, on := range e.s.caps {
+		if on {
+			caps = append(caps, name)
+		}
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// Command wraps every command so it holds off updates while it runs. IDLE waits for the
+// client for as long as it likes and UID looks up the command it wraps here too, so they're
+// left alone.
+func (e *extension) Command(name string) server.HandlerFactory {
+	if !e.enabled {
+		return nil
+	}
+
+	var factory server.HandlerFactory
+	switch name {
+	case "APPEND":
+		factory = func() server.Handler { return &appendHandler{s: e.s} }
+	case "EXPUNGE":
+		factory = func() server.Handler { return &expungeHandler{s: e.s} }
+	default:
+		factory = e.s.builtin.Command(name)
+	}
+
+	fault := e.s.fault(name)
+	if factory == nil {
+		return nil
+	}
+	return func() server.Handler {
+		handler := factory()
+		if fault != nil {
+			handler = &faultHandler{Handler: handler, fault: fault}
+		}
+		if (name == "IDLE") || (name == "UID") {
+			return handler
+		}
+		return &busyHandler{Handler: handler, busy: &e.s.busy}
+	}
+}
+
+func (e *extension) NewConn(c server.Conn) server.Conn {
+	return &capsConn{Conn: c, s: e.s}
+}
+
+// capsConn leaves out the capabilities that have been turned off with SetCap.
+type capsConn struct {
+	server.Conn
+	s *Server
+}
+
+func (c *capsConn) Capabilities() []string {
+	// the extension's capabilities are added in here so get them before taking the lock
+	all := c.Conn.Capabilities()
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	var caps []string
+	seen := make(map[string]bool)
+	for _, name := range all {
+		if on, set := c.s.caps[name]; (set && !on) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		caps = append(caps, name)
+	}
+	return caps
+}
+
+// busyHandler runs a command while holding off updates.
+type busyHandler struct {
+	server.Handler
+	busy *sync.RWMutex
+}
+
+func (h *busyHandler) Handle(conn server.Conn) error {
+	h.busy.RLock()
+	defer h.busy.RUnlock()
+	return h.Handler.Handle(conn)
+}
+
+func (h *busyHandler) UidHandle(conn server.Conn) error {
+	uidHandler, ok := h.Handler.(server.UidHandler)
+	if !ok {
+		return errors.New("Command unsupported with UID")
+	}
+	h.busy.RLock()
+	defer h.busy.RUnlock()
+	return uidHandler.UidHandle(conn)
+}
+
+var errDropped = errors.New("connection dropped")
+
+// faultHandler runs a Fault in place of or ahead of a command.
+type faultHandler struct {
+	server.Handler
+	fault *Fault
+}
+
+func (h *faultHandler) run(conn server.Conn) error {
+	time.Sleep(h.fault.Delay)
+	if h.fault.Drop {
+		conn.Close()
+		return errDropped
+	}
+	if len(h.fault.No) > 0 {
+		return errors.New(h.fault.No)
+	}
+	return nil
+}
+
+func (h *faultHandler) Handle(conn server.Conn) error {
+	if err := h.run(conn); err != nil {
+		return err
+	}
+	return h.Handler.Handle(conn)
+}
+
+func (h *faultHandler) UidHandle(conn server.Conn) error {
+	uidHandler, ok := h.Handler.(server.UidHandler)
+	if !ok {
+		return errors.New("Command unsupported with UID")
+	}
+	if err := h.run(conn); err != nil {
+		return err
+	}
+	return uidHandler.UidHandle(conn)
+}
+
+// appendHandler is APPEND with the APPENDUID response code from UIDPLUS (RFC 4315).
+type appendHandler struct {
+	commands.Append
+	s *Server
+}
+
+func (h *appendHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	body, err := ioutil.ReadAll(h.Message)
+	if err != nil {
+		return err
+	}
+
+	h.s.backend.mu.Lock()
+	mbox, err := h.s.backend.mailbox(ctx.User.Username(), h.Mailbox)
+	if err != nil {
+		h.s.backend.mu.Unlock()
+		if err == backend.ErrNoSuchMailbox {
+			return server.ErrStatusResp(&imap.StatusResp{Type: imap.StatusRespNo, Code: imap.CodeTryCreate, Info: err.Error()})
+		}
+		return err
+	}
+	uid := mbox.add(h.Flags, h.Date, body)
+	validity := mbox.uidValidity
+	h.s.backend.mu.Unlock()
+
+	if !h.s.hasCap("UIDPLUS") {
+		return nil
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "APPENDUID",
+		Arguments: []interface{}{validity, uid},
+		Info:      "APPEND completed",
+	})
+}
+
+// expungeHandler is EXPUNGE along with UID EXPUNGE from UIDPLUS.
+type expungeHandler struct {
+	s    *Server
+	uids *imap.SeqSet
+}
+
+func (h *expungeHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	set, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.uids, err = imap.ParseSeqSet(set)
+	return err
+}
+
+func (h *expungeHandler) Handle(conn server.Conn) error {
+	return h.expunge(conn, nil)
+}
+
+func (h *expungeHandler) UidHandle(conn server.Conn) error {
+	if !h.s.hasCap("UIDPLUS") || (h.uids == nil) {
+		return errors.New("UID EXPUNGE not supported")
+	}
+	return h.expunge(conn, h.uids)
+}
+
+func (h *expungeHandler) expunge(conn server.Conn, uids *imap.SeqSet) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return errors.New("unknown mailbox")
+	}
+	h.s.backend.mu.Lock()
+	defer h.s.backend.mu.Unlock()
+	mbox.expunge(uids)
+	return nil
+}
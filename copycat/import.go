@@ -0,0 +1,234 @@
+package copycat
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImportMail will seed the cache with the messages in an mbox file or a Maildir so a first
+// sync doesn't have to download them all from the source. Messages are cached by the
+// given identity, which should be the one used to sync. It returns the number of messages cached.
+func ImportMail(cache MessageCache, identity Identity, path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return ImportMaildir(cache, identity, path)
+	}
+
+	mbox, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer mbox.Close()
+	return ImportMbox(cache, identity, mbox)
+}
+
+// ImportMbox will cache every message in an mbox, like the ones in a Google Takeout. The
+// mbox is read a message at a time so it can be any size. The headers Takeout adds are
+// dropped so the messages match the copies on the server.
+func ImportMbox(cache MessageCache, identity Identity, r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	var count int
+	var msg bytes.Buffer
+	var fromLine string
+	blank := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if (len(line) == 0) && (err != nil) {
+			if err != io.EOF {
+				return count, err
+			}
+			break
+		}
+
+		// a new message starts with a 'From ' line after a blank one
+		if blank && bytes.HasPrefix(line, []byte("From ")) {
+			if err := importMessage(cache, identity, stripTakeoutHeaders(mboxMessage(msg.Bytes())), mboxDate(fromLine)); err != nil {
+				return count, err
+			}
+			if msg.Len() > 0 {
+				count++
+			}
+			msg.Reset()
+			fromLine = string(line)
+			blank = false
+			continue
+		}
+		blank = len(bytes.TrimRight(line, "\r\n")) == 0
+
+		// undo the mboxrd quoting of '>From ' lines
+		if unquoted := bytes.TrimLeft(line, ">"); (len(unquoted) < len(line)) && bytes.HasPrefix(unquoted, []byte("From ")) {
+			line = line[1:]
+		}
+		msg.Write(line)
+	}
+
+	if err := importMessage(cache, identity, stripTakeoutHeaders(mboxMessage(msg.Bytes())), mboxDate(fromLine)); err != nil {
+		return count, err
+	}
+	if msg.Len() > 0 {
+		count++
+	}
+
+	log.Printf("imported %d messages from mbox", count)
+	return count, nil
+}
+
+// ImportMaildir will cache every message in the cur and new directories under dir,
+// including any Maildir++ subfolders.
+func ImportMaildir(cache MessageCache, identity Identity, dir string) (int, error) {
+	var count int
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if parent := filepath.Base(filepath.Dir(path)); info.IsDir() || ((parent != "cur") && (parent != "new")) {
+			return nil
+		}
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = importMessage(cache, identity, body, info.ModTime(), maildirFlags(info.Name())...); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	log.Printf("imported %d messages from maildir", count)
+	return count, err
+}
+
+// importMessage will cache a single message. IMAP servers hand out messages with CRLF line
+// endings so the message is converted to match before it is identified. received is used as
+// the INTERNALDATE. If it's not known, the Date header is used instead.
+func importMessage(cache MessageCache, identity Identity, body []byte, received time.Time, flags ...string) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	body = toCRLF(body)
+	msg := MessageData{InternalDate: received, Body: body, Flags: flags}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(body)); (err == nil) && received.IsZero() {
+		if date, err := parsed.Header.Date(); err == nil {
+			msg.InternalDate = date
+		}
+	}
+
+	key, _ := identity.Key(messageHeader(body), uint32(len(body)), body)
+	return cache.Put(key, msg)
+}
+
+// toCRLF will make sure every line of the message ends with CRLF.
+func toCRLF(body []byte) []byte {
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// messageHeader returns everything up to and including the blank line after the headers.
+func messageHeader(body []byte) []byte {
+	if end := bytes.Index(body, []byte("\r\n\r\n")); end >= 0 {
+		return body[:end+4]
+	}
+	return body
+}
+
+// mboxMessage drops the blank line that separates a message from the next 'From ' line.
+func mboxMessage(msg []byte) []byte {
+	if bytes.HasSuffix(msg, []byte("\r\n\r\n")) {
+		return msg[:len(msg)-2]
+	}
+	if bytes.HasSuffix(msg, []byte("\n\n")) {
+		return msg[:len(msg)-1]
+	}
+	return msg
+}
+
+// takeoutHeaders are added to every message by Google Takeout. The copies on the server
+// don't have them so they'd throw off the size and digest the identities use.
+var takeoutHeaders = []string{"X-GM-THRID", "X-Gmail-Labels"}
+
+// stripTakeoutHeaders will drop the takeoutHeaders, along with any lines they're folded onto,
+// from the message's headers.
+func stripTakeoutHeaders(msg []byte) []byte {
+	var stripped bytes.Buffer
+	skipping := false
+	for rest := msg; len(rest) > 0; {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		rest = rest[end:]
+
+		// the body is left alone
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			stripped.Write(line)
+			stripped.Write(rest)
+			break
+		}
+
+		if (line[0] != ' ') && (line[0] != '\t') {
+			name := string(bytes.SplitN(line, []byte(":"), 2)[0])
+			skipping = false
+			for _, header := range takeoutHeaders {
+				skipping = skipping || strings.EqualFold(name, header)
+			}
+		}
+		if !skipping {
+			stripped.Write(line)
+		}
+	}
+	return stripped.Bytes()
+}
+
+// mboxDate pulls the date out of a 'From sender date' line. If it can't be parsed,
+// the zero time is returned.
+func mboxDate(fromLine string) time.Time {
+	fields := strings.Fields(fromLine)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range []string{"Mon Jan _2 15:04:05 -0700 2006", time.ANSIC, time.UnixDate} {
+		if parsed, err := time.Parse(layout, date); err == nil {
+			return parsed
+		}
+	}
+	return time.Time{}
+}
+
+// maildirFlags converts the info part of a Maildir file name (':2,FRS') into IMAP flags.
+func maildirFlags(name string) (flags []string) {
+	info := strings.SplitN(name, ":2,", 2)
+	if len(info) != 2 {
+		return nil
+	}
+
+	for _, flag := range info[1] {
+		switch flag {
+		case 'D':
+			flags = append(flags, `\Draft`)
+		case 'F':
+			flags = append(flags, `\Flagged`)
+		case 'R':
+			flags = append(flags, `\Answered`)
+		case 'S':
+			flags = append(flags, `\Seen`)
+		}
+	}
+	return flags
+}
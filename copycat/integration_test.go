@@ -0,0 +1,642 @@
+package copycat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"copycat-imap/copycat/imaptest"
+)
+
+// newTestServer starts a fake IMAP server with a 'src' and a 'dst' user. Reconnects and
+// idle polls are sped up until the returned func is called.
+func newTestServer(t *testing.T) (*imaptest.Server, func()) {
+	server, err := imaptest.NewServer()
+	if err != nil {
+		t.Fatalf("unable to start test server - %s", err.Error())
+	}
+	server.AddUser("src", "srcpw")
+	server.AddUser("dst", "dstpw")
+
+	reconnectMin, poll, statusPoll := ReconnectMin, idlePoll, folderPoll
+	ReconnectMin, idlePoll, folderPoll = 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond
+	return server, func() {
+		ReconnectMin, idlePoll, folderPoll = reconnectMin, poll, statusPoll
+		server.Close()
+	}
+}
+
+// testClient is the IMAP library the integration test being run is using.
+var testClient string
+
+// forEachClient runs the test once for each IMAP library a Session can use.
+func forEachClient(t *testing.T, test func(t *testing.T)) {
+	for _, client := range []string{ClientGo1, ClientEmersion} {
+		testClient = client
+		t.Run(client, test)
+	}
+}
+
+func testInbox(server *imaptest.Server, user string) InboxInfo {
+	return InboxInfo{User: user, Pw: user + "pw", Host: server.Addr(), TLS: TLSConfig{Mode: "plain"}, Client: testClient}
+}
+
+// addMessages puts a message in the mailbox for each Message-ID.
+func addMessages(t *testing.T, server *imaptest.Server, user string, mailbox string, ids ...string) {
+	for _, id := range ids {
+		if _, err := server.AddMessage(user, mailbox, imaptest.NewMessage(id, "message "+id)); err != nil {
+			t.Fatalf("unable to add %s to %s - %s", id, mailbox, err.Error())
+		}
+	}
+}
+
+// messageFlags returns the flags of each message in the mailbox by Message-ID.
+func messageFlags(t *testing.T, server *imaptest.Server, user string, mailbox string) map[string][]string {
+	msgs, err := server.Messages(user, mailbox)
+	if err != nil {
+		t.Fatalf("unable to get messages in %s - %s", mailbox, err.Error())
+	}
+
+	flags := make(map[string][]string)
+	for _, msg := range msgs {
+		id, _ := MessageIdIdentity{}.Key(msg.Body, uint32(len(msg.Body)), msg.Body)
+		flags[id] = msg.Flags
+	}
+	return flags
+}
+
+func TestSync(t *testing.T) {
+	forEachClient(t, testSync)
+}
+
+func testSync(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+	dbLoc := filepath.Join(t.TempDir(), "synctest")
+
+	addMessages(t, server, "src", "INBOX", "<1@example.com>", "<2@example.com>", "<3@example.com>")
+	server.SetFlags("src", "INBOX", 2, `\Seen`)
+	server.AddMailbox("src", "Work")
+	addMessages(t, server, "src", "Work", "<work@example.com>")
+	addMessages(t, server, "dst", "INBOX", "<2@example.com>", "<gone@example.com>")
+
+	srcInfo, dstInfo := testInbox(server, "src"), testInbox(server, "dst")
+	conns, err := initiateConnections(srcInfo, []InboxInfo{dstInfo}, 2)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer conns.Close()
+
+	policies := map[string]PurgePolicy{"dst": {}}
+	cache := NewMemoryCache(100)
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Purge: true, Policies: policies, Cache: cache, DBFile: dbLoc}); err != nil {
+		t.Errorf("unable to sync - %s", err.Error())
+		return
+	}
+
+	inbox := messageFlags(t, server, "dst", "INBOX")
+	if len(inbox) != 3 {
+		t.Errorf("dst INBOX has %v - expected <1>, <2> and <3>", inbox)
+	}
+	if _, ok := inbox["<gone@example.com>"]; ok {
+		t.Errorf("<gone@example.com> was not purged from dst INBOX")
+	}
+	if flags := inbox["<2@example.com>"]; (len(flags) != 1) || (flags[0] != `\Seen`) {
+		t.Errorf("<2@example.com> has flags %v in dst - expected \\Seen", flags)
+	}
+	if work := messageFlags(t, server, "dst", "Work"); len(work) != 1 {
+		t.Errorf("dst Work has %v - expected <work@example.com>", work)
+	}
+
+	// an APPEND cut off by a dropped connection isn't retried. the folder is diffed
+	// again instead so the message is only stored if it didn't make it.
+	addMessages(t, server, "src", "INBOX", "<4@example.com>")
+	logins := server.Count("LOGIN") + server.Count("AUTHENTICATE")
+	server.Inject(imaptest.Fault{Command: "APPEND", Times: 1, Drop: true})
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Purge: true, Policies: policies, Cache: cache, DBFile: dbLoc}); err != nil {
+		t.Errorf("unable to sync after dropped connection - %s", err.Error())
+		return
+	}
+	if inbox = messageFlags(t, server, "dst", "INBOX"); len(inbox) != 4 {
+		t.Errorf("dst INBOX has %v after dropped connection - expected <1> to <4>", inbox)
+	}
+	if msgs, _ := server.Messages("dst", "INBOX"); len(msgs) != 4 {
+		t.Errorf("dst INBOX has %d messages after dropped connection - expected 4", len(msgs))
+	}
+	if server.Count("LOGIN")+server.Count("AUTHENTICATE") == logins {
+		t.Errorf("dropped connection was not reconnected")
+	}
+
+	// without CONDSTORE, flag changes on synced messages wait for a flag scan
+	defer func(interval int) { FlagScanInterval = interval }(FlagScanInterval)
+	FlagScanInterval = 1
+	server.SetFlags("src", "INBOX", 1, `\Flagged`)
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Policies: policies, Cache: cache, DBFile: dbLoc}); err != nil {
+		t.Errorf("unable to sync flag changes - %s", err.Error())
+		return
+	}
+	if flags := messageFlags(t, server, "dst", "INBOX")["<1@example.com>"]; (len(flags) != 1) || (flags[0] != `\Flagged`) {
+		t.Errorf("<1@example.com> has flags %v in dst after a flag scan - expected \\Flagged", flags)
+	}
+
+	// a message that can't be stored fails the sync and is picked up by the next one
+	addMessages(t, server, "src", "INBOX", "<5@example.com>")
+	server.Inject(imaptest.Fault{Command: "APPEND", Times: 1, No: "try again later"})
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Policies: policies, Cache: cache, DBFile: dbLoc}); err == nil {
+		t.Errorf("sync with a failed append did not return an error")
+	}
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Policies: policies, Cache: cache, DBFile: dbLoc}); err != nil {
+		t.Errorf("unable to sync after a failed append - %s", err.Error())
+		return
+	}
+	if inbox = messageFlags(t, server, "dst", "INBOX"); len(inbox) != 5 {
+		t.Errorf("dst INBOX has %v after a failed append - expected <1> to <5>", inbox)
+	}
+}
+
+// plannedKeys returns the keys of the planned messages in order.
+func plannedKeys(msgs []PlannedMessage) []string {
+	var keys []string
+	for _, msg := range msgs {
+		keys = append(keys, msg.Key)
+	}
+	return keys
+}
+
+func TestPlan(t *testing.T) {
+	forEachClient(t, testPlan)
+}
+
+func testPlan(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+	dbLoc := filepath.Join(t.TempDir(), "synctest")
+
+	addMessages(t, server, "src", "INBOX", "<1@example.com>", "<2@example.com>", "<3@example.com>")
+	server.AddMailbox("src", "Work")
+	addMessages(t, server, "src", "Work", "<work@example.com>")
+	addMessages(t, server, "dst", "INBOX", "<2@example.com>", "<gone@example.com>")
+
+	srcInfo, dstInfo := testInbox(server, "src"), testInbox(server, "dst")
+	conns, err := initiateConnections(srcInfo, []InboxInfo{dstInfo}, 2)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer conns.Close()
+
+	policies := map[string]PurgePolicy{"dst": {Mode: PurgeMove, Folder: "Purged"}}
+	cache := NewMemoryCache(100)
+	plan := NewPlan()
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Purge: true, Policies: policies, Cache: cache, DBFile: dbLoc, Plan: plan}); err != nil {
+		t.Errorf("unable to plan - %s", err.Error())
+		return
+	}
+
+	dst := plan.Destinations["dst"]
+	if dst == nil {
+		t.Errorf("plan has no work for dst")
+		return
+	}
+	if (dst.PurgePolicy == nil) || (dst.PurgePolicy.String() != "move to Purged") {
+		t.Errorf("plan has purge policy %v for dst - expected move to Purged", dst.PurgePolicy)
+	}
+	if created := fmt.Sprint(dst.CreateFolders); !strings.Contains(created, "Work") || !strings.Contains(created, "Purged") {
+		t.Errorf("plan creates %s in dst - expected Work and Purged", created)
+	}
+	if inbox := dst.Folders["INBOX"]; inbox == nil {
+		t.Errorf("plan has no work for dst INBOX")
+	} else {
+		if keys := fmt.Sprint(plannedKeys(inbox.Append)); keys != "[<1@example.com> <3@example.com>]" {
+			t.Errorf("plan appends %s to dst INBOX - expected <1> and <3>", keys)
+		}
+		if keys := fmt.Sprint(plannedKeys(inbox.Purge)); keys != "[<gone@example.com>]" {
+			t.Errorf("plan purges %s from dst INBOX - expected <gone>", keys)
+		}
+	}
+	if work := dst.Folders["Work"]; (work == nil) || (len(work.Append) != 1) {
+		t.Errorf("plan does not append <work@example.com> to the new dst Work folder")
+	}
+
+	// planning leaves the mailboxes and the sync state alone
+	if inbox := messageFlags(t, server, "dst", "INBOX"); len(inbox) != 2 {
+		t.Errorf("dst INBOX has %v after planning - expected it unchanged", inbox)
+	}
+	if _, err := server.Messages("dst", "Work"); err == nil {
+		t.Errorf("dst Work was created by planning")
+	}
+	if _, err := os.Stat(stateFile(dbLoc)); !os.IsNotExist(err) {
+		t.Errorf("sync state was written by planning")
+	}
+
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Purge: true, Policies: policies, Cache: cache, DBFile: dbLoc}); err != nil {
+		t.Errorf("unable to sync - %s", err.Error())
+		return
+	}
+
+	// a message deleted from the destination after it was synced isn't stored again,
+	// so it isn't planned either.
+	msgs, err := server.Messages("dst", "INBOX")
+	if err != nil {
+		t.Fatalf("unable to get messages in dst INBOX - %s", err.Error())
+	}
+	for _, msg := range msgs {
+		if id, _ := (MessageIdIdentity{}).Key(msg.Body, uint32(len(msg.Body)), msg.Body); id == "<3@example.com>" {
+			server.RemoveMessage("dst", "INBOX", msg.UID)
+		}
+	}
+	addMessages(t, server, "src", "INBOX", "<4@example.com>")
+
+	plan = NewPlan()
+	if err = Sync(context.Background(), conns.Source, conns.Dest, SyncOptions{Purge: true, Policies: policies, Cache: cache, DBFile: dbLoc, Plan: plan}); err != nil {
+		t.Errorf("unable to plan after a sync - %s", err.Error())
+		return
+	}
+	if dst = plan.Destinations["dst"]; (dst == nil) || (dst.Folders["INBOX"] == nil) {
+		t.Errorf("plan has no work for dst INBOX after a sync")
+		return
+	}
+	if keys := fmt.Sprint(plannedKeys(dst.Folders["INBOX"].Append)); keys != "[<4@example.com>]" {
+		t.Errorf("plan appends %s to dst INBOX after a sync - expected only <4>", keys)
+	}
+	if len(dst.CreateFolders) != 0 {
+		t.Errorf("plan creates %v in dst after a sync - expected nothing", dst.CreateFolders)
+	}
+}
+
+func TestSearchAndPurge(t *testing.T) {
+	forEachClient(t, testSearchAndPurge)
+}
+
+func testSearchAndPurge(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	// without MOVE, purged messages are copied and then expunged
+	server.SetCap("MOVE", false)
+	addMessages(t, server, "src", "INBOX", "<1@example.com>", "<2@example.com>")
+	addMessages(t, server, "dst", "INBOX", "<1@example.com>", "<2@example.com>", "<3@example.com>", "<4@example.com>")
+	server.SetFlags("dst", "INBOX", 1, `\Deleted`)
+
+	srcInfo, dstInfo := testInbox(server, "src"), testInbox(server, "dst")
+	conns, err := initiateConnections(srcInfo, []InboxInfo{dstInfo}, 2)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer conns.Close()
+
+	// a purger losing its connection should pick up where it left off
+	server.Inject(imaptest.Fault{Command: "COPY", Times: 1, Drop: true})
+	policies := map[string]PurgePolicy{"dst": {Mode: PurgeMove, Folder: "Purged"}}
+	if err = SearchAndPurge(context.Background(), conns.Source, conns.Dest, policies, NewMemoryCache(100), MessageIdIdentity{}, nil); err != nil {
+		t.Errorf("unable to purge - %s", err.Error())
+		return
+	}
+
+	// UID EXPUNGE should have left <1> alone even though someone else deleted it
+	inbox := messageFlags(t, server, "dst", "INBOX")
+	if _, ok := inbox["<1@example.com>"]; !ok || (len(inbox) != 2) {
+		t.Errorf("dst INBOX has %v after purge - expected <1> and <2>", inbox)
+	}
+	purged := messageFlags(t, server, "dst", "Purged")
+	_, ok3 := purged["<3@example.com>"]
+	_, ok4 := purged["<4@example.com>"]
+	if !ok3 || !ok4 || (len(purged) != 2) {
+		t.Errorf("dst Purged has %v - expected <3> and <4>", purged)
+	}
+
+	// a failed purge has to leave the cached copy for the next one
+	addMessages(t, server, "dst", "INBOX", "<5@example.com>")
+	cache := NewMemoryCache(100)
+	cache.Put("<5@example.com>", MessageData{Body: []byte(imaptest.NewMessage("<5@example.com>", "message 5"))})
+	server.Inject(imaptest.Fault{Command: "STORE", Times: 1, No: "try again later"})
+	policies = map[string]PurgePolicy{"dst": {}}
+	if err = SearchAndPurge(context.Background(), conns.Source, conns.Dest, policies, cache, MessageIdIdentity{}, nil); err != nil {
+		t.Errorf("unable to purge - %s", err.Error())
+		return
+	}
+	if _, err = cache.Get("<5@example.com>"); err != nil {
+		t.Errorf("<5@example.com> was evicted from the cache by a failed purge - %s", err.Error())
+	}
+
+	// without UIDPLUS, expunging would take <1> with it so purged messages are only flagged.
+	// capabilities are read when logging in so connect again.
+	server.SetCap("UIDPLUS", false)
+	noUIDPlus, err := initiateConnections(srcInfo, []InboxInfo{dstInfo}, 2)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer noUIDPlus.Close()
+	if err = SearchAndPurge(context.Background(), noUIDPlus.Source, noUIDPlus.Dest, policies, cache, MessageIdIdentity{}, nil); err != nil {
+		t.Errorf("unable to purge without UIDPLUS - %s", err.Error())
+		return
+	}
+	if _, err = cache.Get("<5@example.com>"); err != ErrNotFound {
+		t.Errorf("<5@example.com> was left in the cache after it was purged - Get returned %v", err)
+	}
+	inbox = messageFlags(t, server, "dst", "INBOX")
+	if _, ok := inbox["<1@example.com>"]; !ok || (len(inbox) != 3) {
+		t.Errorf("dst INBOX has %v after purge without UIDPLUS - expected <1>, <2> and <5>", inbox)
+	}
+	if flags := inbox["<5@example.com>"]; !hasFlag(flags, `\Deleted`) {
+		t.Errorf("<5@example.com> has flags %v after purge without UIDPLUS - expected \\Deleted", flags)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	forEachClient(t, testIdle)
+}
+
+func testIdle(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	addMessages(t, server, "src", "INBOX", "<1@example.com>")
+	src, err := GetConnection(testInbox(server, "src"), true)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer logout(src)
+
+	appendRequests := make(chan WorkRequest, 10)
+	purgeRequests := make(chan Folder, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- Idle(context.Background(), src, Folder{Name: "INBOX", Delim: "/"}, MessageIdIdentity{}, []chan WorkRequest{appendRequests}, purgeRequests)
+	}()
+
+	waitFor := func(what string, ok func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !ok(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the idle to start", func() bool { return server.Count("IDLE") > 0 })
+
+	addMessages(t, server, "src", "INBOX", "<2@example.com>")
+	select {
+	case request := <-appendRequests:
+		if (request.Type != AppendWork) || (request.Value != "<2@example.com>") || (request.UID != 2) {
+			t.Errorf("new message request was %s/%d - expected an append of <2@example.com>", request.Value, request.UID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the new message")
+	}
+
+	waitFor("the idle to restart", func() bool { return server.Count("IDLE") > 1 })
+	server.SetFlags("src", "INBOX", 1, `\Flagged`)
+	select {
+	case request := <-appendRequests:
+		if (request.Type != FlagWork) || (request.UID != 1) || (strings.Join(request.Flags, " ") != `\Flagged`) {
+			t.Errorf("flag request was %v for %d - expected \\Flagged for 1", request.Flags, request.UID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the flag update")
+	}
+
+	waitFor("the idle to restart", func() bool { return server.Count("IDLE") > 2 })
+	server.RemoveMessage("src", "INBOX", 1)
+	select {
+	case folder := <-purgeRequests:
+		if folder.Name != "INBOX" {
+			t.Errorf("purge was requested for %s - expected INBOX", folder.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the purge request")
+	}
+
+	// the idle should give up once the connection is gone
+	server.DropConnections()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Errorf("idle did not return an error after the connection dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the idle to stop")
+	}
+}
+
+func TestPollFolders(t *testing.T) {
+	forEachClient(t, testPollFolders)
+}
+
+func testPollFolders(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	server.AddMailbox("src", "Work")
+	addMessages(t, server, "src", "Work", "<1@example.com>")
+	src, err := GetConnection(testInbox(server, "src"), true)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer logout(src)
+
+	// folders past MaxIdleConns share a connection that polls their STATUS
+	appendRequests := make(chan WorkRequest, 10)
+	purgeRequests := make(chan Folder, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		folders := []Folder{{Name: "Work", Delim: "/"}}
+		done <- pollFolders(ctx, src, folders, MessageIdIdentity{}, []chan WorkRequest{appendRequests}, purgeRequests, make(map[string]*polledFolder))
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); server.Count("STATUS") < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the poll to start")
+		}
+	}
+	addMessages(t, server, "src", "Work", "<2@example.com>")
+	select {
+	case request := <-appendRequests:
+		if (request.Value != "<2@example.com>") || (request.Folder.Name != "Work") {
+			t.Errorf("new message request was %s in %s - expected an append of <2@example.com> in Work", request.Value, request.Folder.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the new message")
+	}
+
+	// flag changes are found by comparing the flags without CONDSTORE
+	server.SetFlags("src", "Work", 1, `\Flagged`)
+	select {
+	case request := <-appendRequests:
+		if (request.Type != FlagWork) || (request.UID != 1) || (strings.Join(request.Flags, " ") != `\Flagged`) {
+			t.Errorf("flag request was %v for %d - expected \\Flagged for 1", request.Flags, request.UID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the flag update")
+	}
+
+	server.RemoveMessage("src", "Work", 1)
+	select {
+	case folder := <-purgeRequests:
+		if folder.Name != "Work" {
+			t.Errorf("purge was requested for %s - expected Work", folder.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the purge request")
+	}
+
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Errorf("poll returned %v - expected %s", err, context.Canceled)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	forEachClient(t, testCancel)
+}
+
+func testCancel(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+	dbLoc := filepath.Join(t.TempDir(), "synctest")
+
+	addMessages(t, server, "src", "INBOX", "<1@example.com>")
+	srcInfo, dstInfo := testInbox(server, "src"), testInbox(server, "dst")
+	conns, err := initiateConnections(srcInfo, []InboxInfo{dstInfo}, 2)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer conns.Close()
+
+	// a cancelled sync shouldn't touch the destination
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Sync(ctx, conns.Source, conns.Dest, SyncOptions{Purge: true, Policies: map[string]PurgePolicy{}, Cache: NewMemoryCache(100), DBFile: dbLoc})
+	if err != context.Canceled {
+		t.Errorf("cancelled sync returned %v - expected %s", err, context.Canceled)
+	}
+	if inbox := messageFlags(t, server, "dst", "INBOX"); len(inbox) != 0 {
+		t.Errorf("dst INBOX has %v after a cancelled sync - expected nothing", inbox)
+	}
+
+	// cancelling an idle should end it
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Idle(ctx, conns.Source[0], Folder{Name: "INBOX", Delim: "/"}, MessageIdIdentity{}, nil, make(chan Folder, 10))
+	}()
+	for deadline := time.Now().Add(5 * time.Second); server.Count("IDLE") == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the idle to start")
+		}
+	}
+	cancel()
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			t.Errorf("cancelled idle returned %v - expected %s", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the idle to stop")
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	forEachClient(t, testStoreFailure)
+}
+
+func testStoreFailure(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	dst, err := GetConnection(testInbox(server, "dst"), false)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer logout(dst)
+
+	// a storer that can't search the destination has to hold the state back
+	server.Inject(imaptest.Fault{Command: "SEARCH", Times: 1, No: "try again later"})
+	state := &FolderState{LastUID: 1}
+	requests := make(chan WorkRequest)
+	var storers sync.WaitGroup
+	storers.Add(1)
+	go CheckAndAppendMessages(context.Background(), dst, requests, nil, state, newMessageIndex(MessageIdIdentity{}), &storers)
+	requests <- WorkRequest{Value: "<2@example.com>", Header: "Message-Id", UID: 2}
+	close(requests)
+	storers.Wait()
+
+	if state.Complete(2, 0); state.LastUID != 1 {
+		t.Errorf("LastUID moved to %d after a failed search - expected 1", state.LastUID)
+	}
+}
+
+func TestFetchMissing(t *testing.T) {
+	forEachClient(t, testFetchMissing)
+}
+
+func testFetchMissing(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	addMessages(t, server, "src", "INBOX", "<1@example.com>")
+	src, err := GetConnection(testInbox(server, "src"), true)
+	if err != nil {
+		t.Fatalf("unable to connect to test server - %s", err.Error())
+	}
+	defer logout(src)
+
+	cache := NewMemoryCache(100)
+	requests := make(chan fetchRequest)
+	go fetchEmails(context.Background(), src, requests, cache)
+	defer close(requests)
+
+	response := make(chan MessageData)
+	requests <- fetchRequest{Key: "<gone@example.com>", UID: 50, Response: response}
+	if msg := <-response; len(msg.Body) > 0 {
+		t.Errorf("fetch of a missing message returned %d bytes", len(msg.Body))
+	}
+	if _, err = cache.Get("<gone@example.com>"); err != ErrNotFound {
+		t.Errorf("missing message was cached - Get returned %v", err)
+	}
+}
+
+func TestConnectionFaults(t *testing.T) {
+	forEachClient(t, testConnectionFaults)
+}
+
+func testConnectionFaults(t *testing.T) {
+	server, cleanUp := newTestServer(t)
+	defer cleanUp()
+	info := testInbox(server, "src")
+
+	server.Inject(imaptest.Fault{Command: "AUTHENTICATE", Times: 1, No: "try again later"})
+	if _, err := GetConnection(info, true); (err == nil) || !strings.Contains(err.Error(), "try again later") {
+		t.Errorf("login returned %v - expected the server's NO", err)
+	}
+
+	// read-only connections EXAMINE the INBOX
+	server.Inject(imaptest.Fault{Command: "EXAMINE", Times: 1, Delay: 100 * time.Millisecond})
+	start := time.Now()
+	conn, err := GetConnection(info, true)
+	if err != nil {
+		t.Errorf("unable to connect after the faults - %s", err.Error())
+		return
+	}
+	defer logout(conn)
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("slow EXAMINE only took %s", took)
+	}
+
+	// a reconnect that keeps failing gives up waiting once ctx is done
+	server.Inject(imaptest.Fault{Command: "AUTHENTICATE", Times: ReconnectAttempts, No: "try again later"})
+	server.DropConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err = reconnect(ctx, conn); err != context.DeadlineExceeded {
+		t.Errorf("reconnect returned %v - expected %v", err, context.DeadlineExceeded)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("cancelled reconnect took %s", took)
+	}
+}
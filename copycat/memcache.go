@@ -0,0 +1,63 @@
+package copycat
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// MemcacheCache is a MessageCache backed by memcached. Memcached will only hold
+// items up to 1MB by default so larger messages will fail to cache.
+type MemcacheCache struct {
+	client *memcache.Client
+	codec  *valueCodec
+}
+
+func NewMemcacheCache(servers ...string) *MemcacheCache {
+	return &MemcacheCache{client: memcache.New(servers...)}
+}
+
+func (c *MemcacheCache) Get(id string) (MessageData, error) {
+	var md MessageData
+	item, err := c.client.Get(memcacheKey(id))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return md, ErrNotFound
+		}
+		return md, err
+	}
+
+	err = c.codec.decode(item.Value, &md)
+	return md, err
+}
+
+func (c *MemcacheCache) Put(id string, data MessageData) error {
+	rawData, err := c.codec.encode(data)
+	if err != nil {
+		return err
+	}
+
+	return c.client.Set(&memcache.Item{Key: memcacheKey(id), Value: rawData})
+}
+
+func (c *MemcacheCache) Delete(id string) error {
+	err := c.client.Delete(memcacheKey(id))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// Iterate is not supported since memcached can't list its keys.
+func (c *MemcacheCache) Iterate(fn func(id string, data MessageData) error) error {
+	return ErrIterateNotSupported
+}
+
+func (c *MemcacheCache) Close() {}
+
+// memcacheKey hashes the id since memcached keys can't hold spaces or be longer than 250 bytes.
+func memcacheKey(id string) string {
+	hash := sha1.Sum([]byte(id))
+	return hex.EncodeToString(hash[:])
+}
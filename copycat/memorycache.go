@@ -0,0 +1,86 @@
+package copycat
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MemoryCache is a MessageCache that keeps up to a fixed number of messages in memory,
+// evicting the least recently used. It is mostly useful for tests and short lived runs.
+type MemoryCache struct {
+	maxItems int
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+type memoryEntry struct {
+	id   string
+	data MessageData
+}
+
+func NewMemoryCache(maxItems int) *MemoryCache {
+	if maxItems <= 0 {
+		maxItems = 1000
+	}
+	return &MemoryCache{maxItems: maxItems, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *MemoryCache) Get(id string) (MessageData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[id]
+	if !ok {
+		return MessageData{}, ErrNotFound
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).data, nil
+}
+
+func (c *MemoryCache) Put(id string, data MessageData) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[id]; ok {
+		elem.Value.(*memoryEntry).data = data
+		c.order.MoveToFront(elem)
+		return nil
+	}
+
+	c.items[id] = c.order.PushFront(&memoryEntry{id: id, data: data})
+	for c.order.Len() > c.maxItems {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*memoryEntry).id)
+	}
+	return nil
+}
+
+func (c *MemoryCache) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[id]; ok {
+		c.order.Remove(elem)
+		delete(c.items, id)
+	}
+	return nil
+}
+
+// Iterate goes from the most to the least recently used message.
+func (c *MemoryCache) Iterate(fn func(id string, data MessageData) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*memoryEntry)
+		if err := fn(entry.id, entry.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) Close() {}
@@ -0,0 +1,147 @@
+package copycat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// GoogleTokenURL is the token endpoint used when an OAuthConfig doesn't set one.
+const GoogleTokenURL = "https://oauth2.googleapis.com/token"
+
+// OAuthConfig logs in with an OAuth2 access token instead of a password. Access tokens
+// are fetched with the refresh token or, if there isn't one, the client credentials
+// grant. They are refreshed as needed whenever a connection logs in.
+type OAuthConfig struct {
+	// Mechanism is the SASL mechanism: 'xoauth2' (default) or 'oauthbearer'.
+	Mechanism    string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	Scopes       []string
+}
+
+func (o *OAuthConfig) Validate() error {
+	switch strings.ToLower(o.Mechanism) {
+	case "", "xoauth2", "oauthbearer":
+	default:
+		return errors.New("Unknown OAuth mechanism: " + o.Mechanism)
+	}
+
+	if len(o.ClientID) == 0 {
+		return errors.New("OAuth client ID is required.")
+	}
+
+	if (len(o.RefreshToken) == 0) && (len(o.ClientSecret) == 0) {
+		return errors.New("OAuth needs a refresh token or a client secret.")
+	}
+
+	return nil
+}
+
+func (o *OAuthConfig) tokenURL() string {
+	if len(o.TokenURL) == 0 {
+		return GoogleTokenURL
+	}
+	return o.TokenURL
+}
+
+// tokenSource returns a source that hands out the current access token and
+// refreshes it when it's about to expire.
+func (o *OAuthConfig) tokenSource() oauth2.TokenSource {
+	if len(o.RefreshToken) > 0 {
+		config := &oauth2.Config{
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: o.tokenURL()},
+			Scopes:       o.Scopes,
+		}
+		return config.TokenSource(context.Background(), &oauth2.Token{RefreshToken: o.RefreshToken})
+	}
+
+	config := &clientcredentials.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		TokenURL:     o.tokenURL(),
+		Scopes:       o.Scopes,
+	}
+	return config.TokenSource(context.Background())
+}
+
+// tokenSources holds a token source for each user on each host so every connection
+// shares the same tokens.
+var tokenSources = struct {
+	sync.Mutex
+	users map[string]oauth2.TokenSource
+}{users: make(map[string]oauth2.TokenSource)}
+
+// oauthLogin will authenticate the connection with a fresh access token.
+func oauthLogin(conn Session, info InboxInfo) error {
+	host, addr := info.TLS.address(info.Host)
+	_, port, _ := net.SplitHostPort(addr)
+
+	key := host + "\x00" + info.User
+	tokenSources.Lock()
+	source, ok := tokenSources.users[key]
+	if !ok {
+		source = info.OAuth.tokenSource()
+		tokenSources.users[key] = source
+	}
+	tokenSources.Unlock()
+
+	token, err := source.Token()
+	if err != nil {
+		return err
+	}
+
+	var auth SASL
+	if strings.ToLower(info.OAuth.Mechanism) == "oauthbearer" {
+		auth = oauthBearerAuth(info.User, host, port, token.AccessToken)
+	} else {
+		auth = xoauth2Auth(info.User, token.AccessToken)
+	}
+
+	return conn.Authenticate(auth)
+}
+
+// oauthSASL sends the initial response and answers the server's error
+// challenge with reply so the server can fail the login.
+type oauthSASL struct {
+	mech     string
+	response string
+	reply    string
+}
+
+func (a *oauthSASL) Start() (string, []byte, error) {
+	return a.mech, []byte(a.response), nil
+}
+
+func (a *oauthSASL) Next(challenge []byte) ([]byte, error) {
+	return []byte(a.reply), nil
+}
+
+// xoauth2Auth returns Google's XOAUTH2 mechanism.
+func xoauth2Auth(user string, token string) SASL {
+	return &oauthSASL{
+		mech:     "XOAUTH2",
+		response: "user=" + user + "\x01auth=Bearer " + token + "\x01\x01",
+	}
+}
+
+// oauthBearerAuth returns the RFC 7628 OAUTHBEARER mechanism. host and port are
+// the server that was dialed.
+func oauthBearerAuth(user string, host string, port string, token string) SASL {
+	// the GS2 header escapes ',' and '=' in the authzid (RFC 5801)
+	authzId := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	return &oauthSASL{
+		mech:     "OAUTHBEARER",
+		response: "n,a=" + authzId + ",\x01host=" + host + "\x01port=" + port + "\x01auth=Bearer " + token + "\x01\x01",
+		reply:    "\x01",
+	}
+}
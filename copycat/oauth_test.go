@@ -0,0 +1,56 @@
+package copycat
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOAuthSASL(t *testing.T) {
+	mech, ir, _ := xoauth2Auth("user@example.com", "token").Start()
+	if expected := "user=user@example.com\x01auth=Bearer token\x01\x01"; (mech != "XOAUTH2") || (string(ir) != expected) {
+		t.Errorf("xoauth2 sent %s %q - expected XOAUTH2 %q", mech, ir, expected)
+	}
+
+	auth := oauthBearerAuth("user@example.com", "imap.example.com", "143", "token")
+	mech, ir, _ = auth.Start()
+	if expected := "n,a=user@example.com,\x01host=imap.example.com\x01port=143\x01auth=Bearer token\x01\x01"; (mech != "OAUTHBEARER") || (string(ir) != expected) {
+		t.Errorf("oauthbearer sent %s %q - expected OAUTHBEARER %q", mech, ir, expected)
+	}
+	if _, ir, _ = oauthBearerAuth("a=b,c", "imap.example.com", "993", "token").Start(); !strings.HasPrefix(string(ir), "n,a=a=3Db=2Cc,\x01") {
+		t.Errorf("oauthbearer sent %q - expected the authzid to be escaped", ir)
+	}
+	if reply, _ := auth.Next([]byte(`{"status":"invalid_token"}`)); string(reply) != "\x01" {
+		t.Errorf("oauthbearer answered an error with %q - expected ^A", reply)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+	var refreshes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" {
+			t.Errorf("unexpected token request: %v", r.Form)
+		}
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		// expires_in under the expiry delta forces a refresh every time
+		fmt.Fprintf(w, `{"access_token":"access%d","token_type":"Bearer","expires_in":1}`, refreshes)
+	}))
+	defer server.Close()
+
+	config := &OAuthConfig{TokenURL: server.URL, ClientID: "id", RefreshToken: "refresh"}
+	if err := config.Validate(); err != nil {
+		t.Errorf("valid oauth config failed validation: %s", err.Error())
+	}
+
+	source := config.tokenSource()
+	for i := 1; i <= 2; i++ {
+		token, err := source.Token()
+		if err != nil || token.AccessToken != fmt.Sprintf("access%d", i) {
+			t.Errorf("token %d was %v (%v) - expected a refreshed token", i, token, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package copycat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Plan holds everything a sync would change in each destination without changing it.
+// It's filled in by Sync and its workers, which read the sync state like a real sync
+// would but leave the mailboxes and the state alone.
+type Plan struct {
+	// Destinations is keyed by the destination's user.
+	Destinations map[string]*DestPlan `json:"destinations"`
+
+	mu sync.Mutex
+}
+
+// DestPlan is the work planned for a single destination.
+type DestPlan struct {
+	// PurgePolicy is only set if the plan includes a purge. PurgeFallback explains
+	// how the server would fall short of it, if it would.
+	PurgePolicy   *PurgePolicy           `json:"purge_policy,omitempty"`
+	PurgeFallback string                 `json:"purge_fallback,omitempty"`
+	CreateFolders []string               `json:"create_folders,omitempty"`
+	Folders       map[string]*FolderPlan `json:"folders,omitempty"`
+}
+
+// FolderPlan is the work planned for a single destination folder.
+type FolderPlan struct {
+	Append []PlannedMessage `json:"append,omitempty"`
+	Flags  []PlannedMessage `json:"flags,omitempty"`
+	Purge  []PlannedMessage `json:"purge,omitempty"`
+}
+
+// PlannedMessage identifies a message in a plan. The UID is the source UID for appends and
+// flag updates and the destination UID for purges.
+type PlannedMessage struct {
+	UID uint32 `json:"uid"`
+	Key string `json:"key"`
+}
+
+func NewPlan() *Plan {
+	return &Plan{Destinations: make(map[string]*DestPlan)}
+}
+
+func (p *Plan) dest(user string) *DestPlan {
+	dst, ok := p.Destinations[user]
+	if !ok {
+		dst = &DestPlan{Folders: make(map[string]*FolderPlan)}
+		p.Destinations[user] = dst
+	}
+	return dst
+}
+
+func (p *Plan) folder(user string, folder string) *FolderPlan {
+	dst := p.dest(user)
+	plan, ok := dst.Folders[folder]
+	if !ok {
+		plan = &FolderPlan{}
+		dst.Folders[folder] = plan
+	}
+	return plan
+}
+
+// creates returns true if the destination folder would have to be created.
+func (p *Plan) creates(user string, folder string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range p.dest(user).CreateFolders {
+		if name == folder {
+			return true
+		}
+	}
+	return false
+}
+
+// addAppend records that the source message would be appended to the destination folder.
+func (p *Plan) addAppend(user string, folder string, msg PlannedMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan := p.folder(user, folder)
+	plan.Append = append(plan.Append, msg)
+}
+
+// addFlags records that the source message's flags would be copied to the destination folder.
+func (p *Plan) addFlags(user string, folder string, msg PlannedMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan := p.folder(user, folder)
+	plan.Flags = append(plan.Flags, msg)
+}
+
+// addPurge records that the destination messages would be purged from the folder.
+func (p *Plan) addPurge(user string, folder string, msgs []PlannedMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan := p.folder(user, folder)
+	plan.Purge = append(plan.Purge, msgs...)
+	sort.Sort(plannedByUID(plan.Purge))
+}
+
+// WriteJSON will write the plan out as JSON.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	out, err := json.MarshalIndent(p, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// WriteText will write the plan out in a human readable form.
+func (p *Plan) WriteText(w io.Writer) error {
+	for _, user := range sortedKeys(p.Destinations) {
+		dst := p.Destinations[user]
+		fmt.Fprintf(w, "%s:\n", user)
+		if dst.PurgePolicy != nil {
+			fmt.Fprintf(w, "  purge policy: %s\n", dst.PurgePolicy)
+			if len(dst.PurgeFallback) > 0 {
+				fmt.Fprintf(w, "    %s\n", dst.PurgeFallback)
+			}
+		}
+		for _, folder := range dst.CreateFolders {
+			fmt.Fprintf(w, "  create folder %s\n", folder)
+		}
+
+		var folders []string
+		for folder := range dst.Folders {
+			folders = append(folders, folder)
+		}
+		sort.Strings(folders)
+
+		for _, folder := range folders {
+			plan := dst.Folders[folder]
+			fmt.Fprintf(w, "  %s: %d to append, %d to update flags, %d to purge\n", folder, len(plan.Append), len(plan.Flags), len(plan.Purge))
+			for _, msg := range plan.Append {
+				fmt.Fprintf(w, "    append UID %d %s\n", msg.UID, msg.Key)
+			}
+			for _, msg := range plan.Flags {
+				fmt.Fprintf(w, "    flags  UID %d %s\n", msg.UID, msg.Key)
+			}
+			for _, msg := range plan.Purge {
+				fmt.Fprintf(w, "    purge  UID %d %s\n", msg.UID, msg.Key)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func sortedKeys(dsts map[string]*DestPlan) []string {
+	var keys []string
+	for key := range dsts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// planDestFolders will record the folders each destination would need created, along with
+// its purge policy if there's a purge, and return each destination's hierarchy delimiter.
+func planDestFolders(dsts map[string][]Session, folders []Folder, runPurge bool, policies map[string]PurgePolicy, plan *Plan) (map[string]string, error) {
+	dstDelims := make(map[string]string)
+	for user, dst := range dsts {
+		delim, err := getDelimiter(dst[0])
+		if err != nil {
+			log.Printf("Unable to get delimiter for %s: %s", user, err.Error())
+			return dstDelims, err
+		}
+		dstDelims[user] = delim
+
+		existing, err := ListFolders(dst[0], FolderFilter{})
+		if err != nil {
+			log.Printf("Unable to list folders for %s: %s", user, err.Error())
+			return dstDelims, err
+		}
+		exists := make(map[string]bool)
+		for _, folder := range existing {
+			exists[folder.Name] = true
+		}
+
+		// the policy's folder for moving purged messages to is created too
+		policy := policies[user]
+		wanted := folders
+		if runPurge && (policy.Mode == PurgeMove) {
+			wanted = append(append([]Folder{}, folders...), Folder{Name: policy.Folder, Delim: "/"})
+		}
+
+		dstPlan := plan.dest(user)
+		for _, folder := range wanted {
+			if name := folder.Path(delim); !folder.isInbox() && !exists[name] {
+				dstPlan.CreateFolders = append(dstPlan.CreateFolders, name)
+				exists[name] = true
+			}
+		}
+		if runPurge {
+			dstPlan.PurgePolicy = &policy
+			dstPlan.PurgeFallback = policy.fallback(dst[0])
+		}
+	}
+	return dstDelims, nil
+}
+
+// planConns drops the destinations that don't have the folder yet since a dry run can't
+// create it to select it. Those are left to planNewFolders.
+func planConns(c conns, folder Folder, dstDelims map[string]string, plan *Plan) conns {
+	existing := conns{Source: c.Source, Dest: make(map[string][]Session)}
+	for user, dst := range c.Dest {
+		if !plan.creates(user, folder.Path(dstDelims[user])) {
+			existing.Dest[user] = dst
+		}
+	}
+	return existing
+}
+
+// planNewFolders will plan an append of every message in the selected source folder to
+// each destination that doesn't have the folder yet.
+func planNewFolders(ctx context.Context, src Session, dsts map[string][]Session, folder Folder, dstDelims map[string]string, identity Identity, quickSyncCount int, plan *Plan) error {
+	var users []string
+	for _, user := range sortedUsers(dsts) {
+		if plan.creates(user, folder.Path(dstDelims[user])) {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	uids, err := listUIDs(src, 0)
+	if err != nil {
+		return err
+	}
+	if (quickSyncCount != 0) && (quickSyncCount < len(uids)) {
+		uids = uids[len(uids)-quickSyncCount:]
+	}
+
+	msgs, errs := scanMessages(ctx, src, identity, uids)
+	for msg := range msgs {
+		for _, user := range users {
+			plan.addAppend(user, folder.Path(dstDelims[user]), PlannedMessage{UID: msg.UID, Key: msg.Key})
+		}
+	}
+	return <-errs
+}
+
+// planStore will record what the storers would do with the source message. Unlike a sync,
+// the destination is always indexed so the plan can tell appends from flag updates. rescan
+// is set when messages that were already synced are being checked for flag changes.
+func planStore(plan *Plan, user string, folder string, msg scannedMessage, index *messageIndex, dst *folderIndex, state *FolderState, rescan bool) {
+	request, ok := index.diff(msg, dst, state)
+	switch {
+	case !ok:
+	case request.Missing && (msg.UID > state.LastUID):
+		plan.addAppend(user, folder, PlannedMessage{UID: msg.UID, Key: msg.Key})
+	case !request.Missing && (rescan || (msg.UID > state.LastUID)):
+		plan.addFlags(user, folder, PlannedMessage{UID: msg.UID, Key: msg.Key})
+	}
+}
+
+type plannedByUID []PlannedMessage
+
+func (s plannedByUID) Len() int           { return len(s) }
+func (s plannedByUID) Less(i, j int) bool { return s[i].UID < s[j].UID }
+func (s plannedByUID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -1,184 +1,277 @@
 package copycat
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"log"
-	"net/mail"
 	"sync"
 	"time"
+)
 
-	"code.google.com/p/go-imap/go1/imap"
-	"github.com/bradfitz/gomemcache/memcache"
+// Purge modes for a PurgePolicy.
+const (
+	PurgeExpunge = "expunge"
+	PurgeMove    = "move"
+	PurgeFlag    = "flag"
 )
 
+// PurgePolicy decides what happens to destination messages that no longer exist in the source.
+type PurgePolicy struct {
+	// Mode is 'expunge' (the default), 'move' or 'flag'. Expunge deletes only the purged
+	// messages with UID EXPUNGE. Move sends them to Folder and flag just marks them as
+	// \Deleted for someone else to clean up. Servers without UIDPLUS can't expunge single
+	// messages so expunge falls back to flag, as does move if the server can't MOVE either.
+	Mode string
+	// Folder is where 'move' puts messages, using '/' to separate levels. It is created if needed.
+	Folder string
+}
+
+func (p PurgePolicy) Validate() error {
+	switch p.Mode {
+	case "", PurgeExpunge, PurgeFlag:
+		return nil
+	case PurgeMove:
+		if len(p.Folder) == 0 {
+			return errors.New("A folder is required to move purged messages.")
+		}
+		return nil
+	}
+	return errors.New("Unknown purge mode: " + p.Mode)
+}
+
+func (p PurgePolicy) String() string {
+	switch p.Mode {
+	case PurgeMove:
+		return "move to " + p.Folder
+	case PurgeFlag:
+		return `flag as \Deleted`
+	}
+	return "expunge"
+}
+
+// fallback describes how the policy would be carried out differently on the connection's
+// server because of what it doesn't support. It's empty if the policy is followed as is.
+func (p PurgePolicy) fallback(conn Session) string {
+	caps := conn.Caps()
+	switch {
+	case p.Mode == PurgeFlag, caps["UIDPLUS"]:
+		return ""
+	case p.Mode != PurgeMove:
+		return `UIDPLUS is not supported so purged messages would only be flagged as \Deleted`
+	case !caps["MOVE"]:
+		return `MOVE and UIDPLUS are not supported so purged messages would be copied and left flagged as \Deleted`
+	}
+	return ""
+}
+
+// prepare will make sure the folder for the 'move' mode exists in the destination
+// and return its name there.
+func (p PurgePolicy) prepare(conn Session) (string, error) {
+	if p.Mode != PurgeMove {
+		return "", nil
+	}
+
+	folder := Folder{Name: p.Folder, Delim: "/"}
+	delim, err := CreateFolders(conn, []Folder{folder})
+	if err != nil {
+		return "", err
+	}
+	return folder.Path(delim), nil
+}
+
+// remove will purge the given UIDs from the selected folder. target is the folder
+// returned by prepare.
+func (p PurgePolicy) remove(conn Session, uids SeqSet, target string) error {
+	// messages already in the target folder have nowhere else to go
+	folder := conn.Selected().Name
+	move := (p.Mode == PurgeMove) && (folder != target)
+	if move && conn.Caps()["MOVE"] {
+		return conn.Move(uids, target)
+	}
+	if move {
+		if err := conn.Copy(uids, target); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.StoreFlags(uids, true, `\Deleted`); err != nil {
+		return err
+	}
+	if p.Mode == PurgeFlag {
+		return nil
+	}
+
+	// a plain EXPUNGE would take anything someone else marked as deleted with it
+	if !conn.Caps()["UIDPLUS"] {
+		log.Printf("UIDPLUS is not supported. leaving the purged messages in %s flagged as deleted", folder)
+		return nil
+	}
+	return conn.Expunge(uids)
+}
+
 // SearchAndPurge will go through the destination inboxes and check if
 // each message exists in the source inbox. If a message does not exist
-// in the source, delete it from the destination.
-func SearchAndPurge(src []*imap.Client, dsts map[string][]*imap.Client) error {
-
-	// setup pool of 'checkers' to see if messages
-	// exist in the source mailbox
-	checkRequests := make(chan checkExistsRequest)
-	var checkers sync.WaitGroup
-	for _, srcConn := range src {
-		checkers.Add(1)
-		go checkMessagesExist(srcConn, checkRequests, &checkers)
+// in the source, it is purged from the destination using the destination's
+// policy and evicted from the cache. Messages are matched up using the given identity.
+// Both sides are paged through once and diffed in memory so only the deletes hit the server.
+// If ctx is done, the purgers finish what they have and its error is returned. If plan is not
+// nil, the messages are recorded in it instead of being purged.
+func SearchAndPurge(ctx context.Context, src []Session, dsts map[string][]Session, policies map[string]PurgePolicy, cache MessageCache, identity Identity, plan *Plan) error {
+	// scan the source once for all destinations
+	srcIndex, err := newMessageIndex(identity).Build(ctx, src[0])
+	if err != nil {
+		log.Printf("Unable to scan source messages: %s", err.Error())
+		return err
 	}
 
 	// setup pool of 'purgers' for each destination
 	var purgers sync.WaitGroup
 	for user, dst := range dsts {
 		purgers.Add(1)
-		go purgeDestination(user, dst, checkRequests, &purgers)
+		go purgeDestination(ctx, user, dst, policies[user], cache, srcIndex, identity, plan, &purgers)
 	}
 
 	// wait for the purgers to complete
 	purgers.Wait()
-	// clean up checkers once purging complete
-	close(checkRequests)
-	// ...and wait for our checkers to complete
-	checkers.Wait()
+	if err = ctx.Err(); err != nil {
+		log.Printf("search and purge interrupted")
+		return err
+	}
 
 	log.Printf("search and purge complete")
 	return nil
 }
 
-// checkAndPurge will pull message message ids off of requests and do some work
-func purgeDestination(user string, dsts []*imap.Client, checkRequests chan checkExistsRequest, wg *sync.WaitGroup) {
+// purgeDestination will page through the destination and pass any messages that aren't in the source to the purgers.
+func purgeDestination(ctx context.Context, user string, dsts []Session, policy PurgePolicy, cache MessageCache, srcIndex *folderIndex, identity Identity, plan *Plan, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	cmd, err := GetAllMessages(dsts[0])
+	var target string
+	var err error
+	if plan == nil {
+		if target, err = policy.prepare(dsts[0]); err != nil {
+			log.Printf("Unable to create purge folder for %s: %s", user, err.Error())
+			return
+		}
+	}
+
+	uids, err := listUIDs(dsts[0], 0)
 	if err != nil {
 		log.Printf("Unable to find destination messages: %s", err.Error())
+		return
+	}
+
+	// the first connection is busy paging through the destination so the purgers get the rest
+	dstMsgs, scanErrs := scanMessages(ctx, dsts[0], identity, uids)
+	purgeConns := dsts
+	if len(dsts) > 1 {
+		purgeConns = dsts[1:]
+	} else {
+		dstMsgs = bufferMessages(dstMsgs)
 	}
 
 	workRequests := make(chan WorkRequest)
 
-	// launch purgers
+	// launch purgers unless this is a dry run
 	var purgers sync.WaitGroup
-	for _, dstConn := range dsts {
-		purgers.Add(1)
-		go checkAndPurgeMessages(dstConn, workRequests, checkRequests, &purgers)
+	if plan == nil {
+		for _, dstConn := range purgeConns {
+			purgers.Add(1)
+			go purgeMessages(ctx, dstConn, policy, target, cache, workRequests, &purgers)
+		}
 	}
 
 	// build the requests and send them
-	var rsp *imap.Response
 	var indx int
+	var planned []PlannedMessage
 	startTime := time.Now()
-	log.Printf("Beginning check/purge for %s with %d messages", user, len(cmd.Data))
-	for indx, rsp = range cmd.Data {
-		header := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.HEADER"])
-		if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
-			header := "Message-Id"
-			value := msg.Header.Get(header)
-
-			// create the store request and pass it to each dst's storers
-			workRequests <- WorkRequest{Value: value, Header: header, UID: rsp.MessageInfo().UID}
-
-			if ((indx % 100) == 0) && (indx > 0) {
-				since := time.Since(startTime)
-				rate := 100 / since.Seconds()
-				startTime = time.Now()
-				log.Printf("Processed %d messages from %s. Rate: %f msg/s", indx, user, rate)
-			}
+	log.Printf("Beginning purge for %s with %d messages", user, len(uids))
+	for msg := range dstMsgs {
+		if (ctx.Err() != nil) || srcIndex.Contains(msg.Key) {
+			continue
+		}
+		if plan != nil {
+			planned = append(planned, PlannedMessage{UID: msg.UID, Key: msg.Key})
+		} else {
+			workRequests <- WorkRequest{Value: msg.Key, Header: msg.Header, UID: msg.UID}
+		}
+
+		if ((indx % 100) == 0) && (indx > 0) {
+			since := time.Since(startTime)
+			rate := 100 / since.Seconds()
+			startTime = time.Now()
+			log.Printf("Processed %d messages from %s. Rate: %f msg/s", indx, user, rate)
 		}
+		indx++
 	}
-	log.Printf("Done passing purge requests for %s", user)
+	if err = <-scanErrs; err != nil {
+		log.Printf("Unable to page through destination messages for %s: %s", user, err.Error())
+	}
+	log.Printf("Done passing purge requests for %s. %d messages not found in src", user, indx)
 	close(workRequests)
 	purgers.Wait()
+	if plan != nil {
+		plan.addPurge(user, dsts[0].Selected().Name, planned)
+	}
 
 	return
 }
 
-func checkAndPurgeMessages(conn *imap.Client, requests chan WorkRequest, checkRequests chan checkExistsRequest, wg *sync.WaitGroup) {
+// purgeMessages will collect the requested messages and purge them with the policy
+// ChunkSize messages at a time. If the connection drops, it is brought back and the
+// chunk is purged again. Once a chunk is purged, its messages are removed from the cache.
+func purgeMessages(ctx context.Context, dstConn Session, policy PurgePolicy, target string, cache MessageCache, requests chan WorkRequest, wg *sync.WaitGroup) {
 	defer wg.Done()
-	
-	timeout := time.NewTicker(NoopMinutes * time.Minute)
-	done := false
-	for {
-		select {
-		case request, ok := <- requests:
-			if !ok {
-				done = true
-				break
-			}
-			// check and wait for response
-			response := make(chan bool)
-			cr := checkExistsRequest{UID: request.UID, MessageId: request.Value, Response: response}
-			checkRequests <- cr
-
-			// if response is false (does not exist), flag as Deleted
-			if exists := <-response; !exists {
-				log.Printf("not found in src. marking for deletion: %s", request.Value)
-				err := AddDeletedFlag(conn, request.UID)
-				if err != nil {
-					log.Printf("Problems removing message from dst: %s", err.Error())
+	conn := &liveConn{Session: current(dstConn)}
+
+	var uids SeqSet
+	var keys []string
+	purge := func() {
+		if len(keys) == 0 {
+			return
+		}
+		log.Printf("purging %d messages...", len(keys))
+		err := conn.do(ctx, func(c Session) error {
+			return policy.remove(c, uids, target)
+		})
+		if err != nil {
+			// keep the cached copies around for the next purge to try again
+			log.Printf("Problems removing messages from dst: %s", err.Error())
+		} else {
+			for _, key := range keys {
+				if err = cache.Delete(key); err != nil {
+					log.Printf("Unable to remove message (%s) from cache: %s", key, err.Error())
 				}
 			}
-		case <- timeout.C:
-			imap.Wait(conn.Noop())
-		}
-		
-		if done {
-			break
 		}
+		uids = nil
+		keys = nil
 	}
-	
-	log.Printf("expunging...")
-	// expunge at the end
-	allMsgs, _ := imap.NewSeqSet("")
-	allMsgs.Add("1:*")
-	imap.Wait(conn.Expunge(allMsgs))
-	log.Printf("expunge complete.")
-}
 
-type checkExistsRequest struct {
-	MessageId string
-	UID       uint32
-	Response  chan bool
-}
-
-func checkMessagesExist(srcConn *imap.Client, checkRequests chan checkExistsRequest, wg *sync.WaitGroup) {
-	defer wg.Done()
-	// get memcache client
-	cache := memcache.New(MemcacheServer)
-	
 	timeout := time.NewTicker(NoopMinutes * time.Minute)
 	done := false
 	for {
 		select {
-		case request, ok := <- checkRequests:
+		case request, ok := <-requests:
 			if !ok {
 				done = true
 				break
 			}
-			// check if it exists in src
-			// search for in src
-			cmd, err := imap.Wait(srcConn.UIDSearch([]imap.Field{"HEADER", "Message-Id", request.MessageId}))
-			if err != nil {
-				log.Printf("Unable to search source: %s", err.Error())
-				request.Response <- true
-				continue
-			}
 
-			results := cmd.Data[0].SearchResults()
-			// if not found, mark for deletion in DST
-			found := (len(results) > 0)
-
-			// response with found bool
-			request.Response <- found
-
-			// if it doesnt exist, attempt to remove it from memcached
-			if !found {
-				cache.Delete(request.MessageId)
-			}			
-		case <- timeout.C:
-			imap.Wait(srcConn.Noop())
+			log.Printf("not found in src. marking for purge: %s", request.Value)
+			uids.AddNum(request.UID)
+			if keys = append(keys, request.Value); len(keys) >= ChunkSize {
+				purge()
+			}
+		case <-timeout.C:
+			conn.Noop()
 		}
-		
+
 		if done {
 			break
 		}
 	}
 
+	purge()
+	log.Printf("purge complete.")
 }
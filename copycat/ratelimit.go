@@ -0,0 +1,260 @@
+package copycat
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit throttles the connections to an inbox's host. Zero values are unlimited.
+type RateLimit struct {
+	// CommandsPerSecond limits how many IMAP commands are sent to the server.
+	CommandsPerSecond float64
+	// BytesPerSecond limits the data sent and received.
+	BytesPerSecond int64
+}
+
+func (r RateLimit) Validate() error {
+	if (r.CommandsPerSecond < 0) || (r.BytesPerSecond < 0) {
+		return errors.New("Rate limits can't be negative.")
+	}
+	return nil
+}
+
+func (r RateLimit) enabled() bool {
+	return (r.CommandsPerSecond > 0) || (r.BytesPerSecond > 0)
+}
+
+// rateLimiter holds the token buckets shared by every connection to a host.
+type rateLimiter struct {
+	commands *tokenBucket
+	bytes    *tokenBucket
+}
+
+// limiters holds a rateLimiter for each host. Inboxes on the same host share
+// one and the first inbox with a RateLimit sets its limits.
+var limiters = struct {
+	sync.Mutex
+	hosts map[string]*rateLimiter
+}{hosts: make(map[string]*rateLimiter)}
+
+// setRateLimits will set up the limiters for every inbox up front so connections to a
+// host are limited even if the inbox with the RateLimit isn't the first to connect.
+func setRateLimits(infos ...InboxInfo) {
+	for _, info := range infos {
+		hostLimiter(info)
+	}
+}
+
+// hostLimiter returns the shared limiter for the inbox's host. It's nil if neither the inbox
+// nor any other on its host is limited.
+func hostLimiter(info InboxInfo) *rateLimiter {
+	host, _ := info.TLS.address(info.Host)
+
+	limiters.Lock()
+	defer limiters.Unlock()
+	limiter, ok := limiters.hosts[host]
+	if !ok && info.RateLimit.enabled() {
+		limiter = &rateLimiter{}
+		if info.RateLimit.CommandsPerSecond > 0 {
+			limiter.commands = newTokenBucket(info.RateLimit.CommandsPerSecond, info.RateLimit.CommandsPerSecond)
+		}
+		if info.RateLimit.BytesPerSecond > 0 {
+			limiter.bytes = newTokenBucket(float64(info.RateLimit.BytesPerSecond), float64(info.RateLimit.BytesPerSecond))
+		}
+		limiters.hosts[host] = limiter
+		log.Printf("limiting %s to %.2f commands/s and %d bytes/s", host, info.RateLimit.CommandsPerSecond, info.RateLimit.BytesPerSecond)
+	}
+	return limiter
+}
+
+// limitedConn waits on the host's limiter before handing data to or from the server.
+type limitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limiter.bytes.wait(float64(n))
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.limiter.bytes.wait(float64(len(p)))
+	return c.Conn.Write(p)
+}
+
+// limitSession will make every command sent over conn wait on the limiter. Checking
+// for CONDSTORE support still works on the returned Session.
+func limitSession(conn Session, limiter *rateLimiter) Session {
+	limited := &limitedSession{Session: conn, commands: limiter.commands}
+	if cs, ok := conn.(condStoreSession); ok {
+		return &limitedCondStoreSession{limitedSession: limited, cs: cs}
+	}
+	return limited
+}
+
+// limitedSession takes a token from the host's command bucket before each command.
+// Logging out and ending an IDLE are never held up.
+type limitedSession struct {
+	Session
+	commands *tokenBucket
+}
+
+func (s *limitedSession) StartTLS(config *tls.Config) error {
+	s.commands.wait(1)
+	return s.Session.StartTLS(config)
+}
+
+func (s *limitedSession) Login(user string, pw string) error {
+	s.commands.wait(1)
+	return s.Session.Login(user, pw)
+}
+
+func (s *limitedSession) Authenticate(auth SASL) error {
+	s.commands.wait(1)
+	return s.Session.Authenticate(auth)
+}
+
+func (s *limitedSession) Noop() error {
+	s.commands.wait(1)
+	return s.Session.Noop()
+}
+
+func (s *limitedSession) List(ref string, pattern string) ([]MailboxInfo, error) {
+	s.commands.wait(1)
+	return s.Session.List(ref, pattern)
+}
+
+func (s *limitedSession) Create(folder string) error {
+	s.commands.wait(1)
+	return s.Session.Create(folder)
+}
+
+func (s *limitedSession) Select(folder string, readOnly bool) error {
+	s.commands.wait(1)
+	return s.Session.Select(folder, readOnly)
+}
+
+func (s *limitedSession) Status(folder string) (*MailboxStatus, error) {
+	s.commands.wait(1)
+	return s.Session.Status(folder)
+}
+
+func (s *limitedSession) Search(criteria SearchCriteria) ([]uint32, error) {
+	s.commands.wait(1)
+	return s.Session.Search(criteria)
+}
+
+func (s *limitedSession) Fetch(seqs SeqSet, items ...string) ([]*Message, error) {
+	s.commands.wait(1)
+	return s.Session.Fetch(seqs, items...)
+}
+
+func (s *limitedSession) UIDFetch(uids SeqSet, items ...string) ([]*Message, error) {
+	s.commands.wait(1)
+	return s.Session.UIDFetch(uids, items...)
+}
+
+func (s *limitedSession) StoreFlags(uids SeqSet, add bool, flags ...string) error {
+	s.commands.wait(1)
+	return s.Session.StoreFlags(uids, add, flags...)
+}
+
+func (s *limitedSession) Copy(uids SeqSet, folder string) error {
+	s.commands.wait(1)
+	return s.Session.Copy(uids, folder)
+}
+
+func (s *limitedSession) Move(uids SeqSet, folder string) error {
+	s.commands.wait(1)
+	return s.Session.Move(uids, folder)
+}
+
+func (s *limitedSession) Expunge(uids SeqSet) error {
+	s.commands.wait(1)
+	return s.Session.Expunge(uids)
+}
+
+func (s *limitedSession) Append(folder string, flags []string, date time.Time, body []byte) (uint32, error) {
+	s.commands.wait(1)
+	return s.Session.Append(folder, flags, date, body)
+}
+
+func (s *limitedSession) Idle() error {
+	s.commands.wait(1)
+	return s.Session.Idle()
+}
+
+// limitedCondStoreSession is a limitedSession over a Session that supports CONDSTORE.
+type limitedCondStoreSession struct {
+	*limitedSession
+	cs condStoreSession
+}
+
+func (s *limitedCondStoreSession) Enable(caps ...string) error {
+	s.commands.wait(1)
+	return s.cs.Enable(caps...)
+}
+
+func (s *limitedCondStoreSession) HighestModSeq(folder string) (uint64, error) {
+	s.commands.wait(1)
+	return s.cs.HighestModSeq(folder)
+}
+
+func (s *limitedCondStoreSession) FetchChangedSince(modSeq uint64, items ...string) ([]*Message, error) {
+	s.commands.wait(1)
+	return s.cs.FetchChangedSince(modSeq, items...)
+}
+
+func (s *limitedCondStoreSession) VanishedSince(modSeq uint64) (SeqSet, error) {
+	s.commands.wait(1)
+	return s.cs.VanishedSince(modSeq)
+}
+
+// tokenBucket fills up with rate tokens a second and holds at most burst. A nil
+// *tokenBucket never waits.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait will take n tokens, sleeping until the bucket has refilled enough to cover
+// them. Asking for more than the burst puts the bucket in debt so later callers wait longer.
+func (b *tokenBucket) wait(n float64) {
+	if (b == nil) || (n <= 0) {
+		return
+	}
+	time.Sleep(b.reserve(n, time.Now()))
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,43 @@
+package copycat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(10, 10)
+	bucket.last = start
+
+	if wait := bucket.reserve(10, start); wait != 0 {
+		t.Errorf("full bucket waited %s for its burst", wait)
+	}
+	if wait := bucket.reserve(5, start); wait != 500*time.Millisecond {
+		t.Errorf("empty bucket waited %s for 5 tokens - expected 500ms", wait)
+	}
+
+	// a second later the debt is paid off and 5 tokens have come back
+	if wait := bucket.reserve(5, start.Add(time.Second)); wait != 0 {
+		t.Errorf("refilled bucket waited %s", wait)
+	}
+
+	// it never holds more than the burst
+	if wait := bucket.reserve(20, start.Add(time.Minute)); wait != time.Second {
+		t.Errorf("bucket waited %s for twice its burst - expected 1s", wait)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	limited := InboxInfo{Host: "limited.example.com:993", RateLimit: RateLimit{CommandsPerSecond: 5}}
+	other := InboxInfo{Host: "limited.example.com"}
+	setRateLimits(other, limited)
+
+	limiter := hostLimiter(other)
+	if (limiter == nil) || (limiter != hostLimiter(limited)) {
+		t.Errorf("inbox without a rate limit didn't share its host's limiter")
+	}
+	if hostLimiter(InboxInfo{Host: "unlimited.example.com"}) != nil {
+		t.Errorf("inbox on an unlimited host was limited")
+	}
+}
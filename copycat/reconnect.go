@@ -0,0 +1,266 @@
+package copycat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ReconnectAttempts is how many times to try bringing back a dead connection before giving up.
+	ReconnectAttempts = 10
+	// ReconnectMin and ReconnectMax bound how long to wait between attempts.
+	ReconnectMin = time.Second
+	ReconnectMax = 5 * time.Minute
+)
+
+// Backoff doubles the wait after each failure up to Max. Each wait is jittered
+// between half and all of it so connections to the same host don't retry in lockstep.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempts uint
+}
+
+func NewBackoff() *Backoff {
+	return &Backoff{Min: ReconnectMin, Max: ReconnectMax}
+}
+
+// Next returns how long to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	wait := b.Max
+	if b.attempts < 32 {
+		if shifted := b.Min << b.attempts; (shifted > 0) && (shifted < b.Max) {
+			wait = shifted
+		}
+	}
+	b.attempts++
+
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
+
+// Reset starts the waits over from Min.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// isDead returns true if the connection has been logged out or dropped.
+func isDead(conn Session) bool {
+	return (conn == nil) || conn.Closed()
+}
+
+// supervisedConn remembers how a connection was made so it can be brought back if it
+// dies. login wraps every connection it makes in one.
+type supervisedConn struct {
+	Session
+	info InboxInfo
+
+	// mu is held while the connection is being replaced so only one worker redials it.
+	mu      sync.Mutex
+	qresync bool
+	// folder is the last folder selected. Some clients forget it once the connection drops.
+	folder   string
+	readOnly bool
+	// replacement is the connection that took this one's place once it died.
+	replacement *supervisedConn
+}
+
+// unwrap returns the Session underneath any supervision so its optional interfaces
+// can be checked.
+func unwrap(conn Session) Session {
+	if s, ok := conn.(*supervisedConn); ok {
+		return s.Session
+	}
+	return conn
+}
+
+// trackQResync marks that QRESYNC has to be enabled again on reconnect.
+func trackQResync(conn Session) {
+	if s, ok := conn.(*supervisedConn); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.qresync = true
+	}
+}
+
+// Select remembers the folder so it can be selected again after a reconnect.
+func (s *supervisedConn) Select(folder string, readOnly bool) error {
+	if err := s.Session.Select(folder, readOnly); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.folder, s.readOnly = folder, readOnly
+	return nil
+}
+
+// current follows conn to the connection that replaced it, if any.
+func current(conn Session) Session {
+	s, ok := conn.(*supervisedConn)
+	if !ok {
+		return conn
+	}
+	for {
+		s.mu.Lock()
+		replacement := s.replacement
+		s.mu.Unlock()
+		if replacement == nil {
+			return s
+		}
+		s = replacement
+	}
+}
+
+// reconnect will log in again with the dead connection's InboxInfo and select the
+// folder it had selected, backing off between attempts. If another worker already
+// replaced the connection, that one is returned. Waiting between attempts stops when ctx is done.
+func reconnect(ctx context.Context, conn Session) (Session, error) {
+	// wait out anyone else reconnecting it and follow whatever they replaced it with
+	var s *supervisedConn
+	for next := conn; ; next = s {
+		var ok bool
+		if s, ok = current(next).(*supervisedConn); !ok {
+			return conn, errors.New("unable to reconnect an unknown connection")
+		}
+		s.mu.Lock()
+		if s.replacement == nil {
+			break
+		}
+		s.mu.Unlock()
+	}
+	defer s.mu.Unlock()
+	if (Session(s) != conn) && !isDead(s) {
+		return s, nil
+	}
+
+	folder, readOnly := s.folder, s.readOnly
+	backoff := NewBackoff()
+	for attempt := 1; ; attempt++ {
+		replacement, err := login(s.info)
+		if err == nil {
+			if s.qresync {
+				enableQResync(replacement)
+			}
+			if len(folder) > 0 {
+				if err = SelectFolder(replacement, folder, readOnly); err != nil {
+					logout(replacement)
+				}
+			}
+		}
+
+		if err == nil {
+			log.Printf("reconnected to %s", s.info.Account())
+			s.Logout(time.Second)
+			s.replacement = replacement.(*supervisedConn)
+			budgets.untrack(s)
+			return replacement, nil
+		}
+
+		if attempt >= ReconnectAttempts {
+			log.Printf("Unable to reconnect to %s after %d attempts: %s", s.info.Account(), attempt, err.Error())
+			return s, err
+		}
+		wait := backoff.Next()
+		log.Printf("Unable to reconnect to %s: %s. trying again in %s", s.info.Account(), err.Error(), wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return s, ctx.Err()
+		}
+	}
+}
+
+// liveConn is a worker's connection. If it dies while running a command, it's replaced
+// with a new one and the command is run again. Once reconnecting fails it stays dead so
+// the worker can get through the rest of its requests quickly. Workers start from the
+// current connection in case an earlier worker already replaced theirs.
+type liveConn struct {
+	Session
+	dead bool
+}
+
+// do runs fn with the connection, reconnecting and trying again if the connection dies.
+func (c *liveConn) do(ctx context.Context, fn func(conn Session) error) error {
+	if c.dead {
+		return errors.New("connection is dead")
+	}
+
+	err := fn(c.Session)
+	for tries := 0; (err != nil) && isDead(c.Session) && (tries < 3); tries++ {
+		log.Printf("lost connection: %s. reconnecting...", err.Error())
+		var rerr error
+		if c.Session, rerr = reconnect(ctx, c.Session); rerr != nil {
+			c.dead = true
+			return err
+		}
+		err = fn(c.Session)
+	}
+	return err
+}
+
+// once runs fn with the connection but doesn't run it again if the connection dies, since
+// the server may have carried out the command before it went away. Commands like APPEND
+// aren't safe to repeat, so that's left to the next sync's diff. The connection is still
+// brought back for the next command.
+func (c *liveConn) once(ctx context.Context, fn func(conn Session) error) error {
+	if c.dead {
+		return errors.New("connection is dead")
+	}
+
+	err := fn(c.Session)
+	if (err != nil) && isDead(c.Session) {
+		log.Printf("lost connection: %s. reconnecting for the next command...", err.Error())
+		var rerr error
+		if c.Session, rerr = reconnect(ctx, c.Session); rerr != nil {
+			c.dead = true
+		}
+	}
+	return err
+}
+
+// revive will swap out any dead connections for ones that have replaced them or new ones.
+func (c *conns) revive(ctx context.Context) error {
+	var err error
+	reviveConn := func(conn Session) Session {
+		conn = current(conn)
+		if isDead(conn) {
+			var rerr error
+			if conn, rerr = reconnect(ctx, conn); rerr != nil {
+				err = rerr
+			}
+		}
+		return conn
+	}
+
+	for i, conn := range c.Source {
+		c.Source[i] = reviveConn(conn)
+	}
+	for _, dst := range c.Dest {
+		for i, conn := range dst {
+			dst[i] = reviveConn(conn)
+		}
+	}
+	return err
+}
+
+// dead returns true if any of the connections have died.
+func (c *conns) dead() bool {
+	for _, conn := range c.Source {
+		if isDead(conn) {
+			return true
+		}
+	}
+	for _, dst := range c.Dest {
+		for _, conn := range dst {
+			if isDead(conn) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package copycat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	backoff := &Backoff{Min: time.Second, Max: 10 * time.Second}
+	for i, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		expected *= time.Second
+		if wait := backoff.Next(); (wait < expected/2) || (wait > expected) {
+			t.Errorf("wait %d was %s - expected between %s and %s", i, wait, expected/2, expected)
+		}
+	}
+
+	backoff.Reset()
+	if wait := backoff.Next(); wait > time.Second {
+		t.Errorf("wait after reset was %s - expected at most 1s", wait)
+	}
+}
@@ -0,0 +1,254 @@
+package copycat
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session is a connection to an IMAP server. Everything that talks to a server goes
+// through it so the IMAP library underneath can be swapped out. All of the message
+// commands work on the selected folder and, other than Fetch, use UIDs.
+type Session interface {
+	// Caps returns the server's capabilities.
+	Caps() map[string]bool
+	StartTLS(config *tls.Config) error
+	Login(user string, pw string) error
+	Authenticate(auth SASL) error
+	Noop() error
+	Logout(timeout time.Duration) error
+	// Closed returns true once the session has been logged out or dropped.
+	Closed() bool
+
+	List(ref string, pattern string) ([]MailboxInfo, error)
+	Create(folder string) error
+	Select(folder string, readOnly bool) error
+	// Selected returns the selected folder or nil if nothing is selected.
+	Selected() *MailboxStatus
+	Status(folder string) (*MailboxStatus, error)
+
+	Search(criteria SearchCriteria) ([]uint32, error)
+	// Fetch gets the given FETCH items of messages by sequence number.
+	Fetch(seqs SeqSet, items ...string) ([]*Message, error)
+	UIDFetch(uids SeqSet, items ...string) ([]*Message, error)
+	// StoreFlags will silently add or remove the flags.
+	StoreFlags(uids SeqSet, add bool, flags ...string) error
+	Copy(uids SeqSet, folder string) error
+	Move(uids SeqSet, folder string) error
+	// Expunge removes the given messages if they're marked as \Deleted with UID EXPUNGE
+	// (RFC 4315). There's no way to send a plain EXPUNGE since it would take everything
+	// anyone marked as deleted with it, so an empty set is an error.
+	Expunge(uids SeqSet) error
+	// Append returns the new message's UID if the server supports UIDPLUS and 0 otherwise.
+	Append(folder string, flags []string, date time.Time, body []byte) (uint32, error)
+
+	// Idle starts an IDLE. Until IdleTerm is called, Updates will return whatever
+	// the server has sent since it was last called without waiting for more.
+	Idle() error
+	Updates() ([]Update, error)
+	IdleTerm() error
+}
+
+// condStoreSession is a Session that can use CONDSTORE and QRESYNC (RFC 7162).
+type condStoreSession interface {
+	Session
+	Enable(caps ...string) error
+	// HighestModSeq returns 0 if the folder does not support mod-sequences.
+	HighestModSeq(folder string) (uint64, error)
+	FetchChangedSince(modSeq uint64, items ...string) ([]*Message, error)
+	VanishedSince(modSeq uint64) (SeqSet, error)
+}
+
+// IMAP libraries a Session can use.
+const (
+	ClientGo1      = "go1"
+	ClientEmersion = "emersion"
+)
+
+// newSession will start an IMAP session over conn using the InboxInfo's client library.
+// host is the server's name for STARTTLS.
+func newSession(info InboxInfo, conn net.Conn, host string) (Session, error) {
+	if strings.ToLower(info.Client) == ClientEmersion {
+		return newEmersionSession(conn, dialTimeout)
+	}
+	return newGo1Session(conn, host, dialTimeout)
+}
+
+// MailboxInfo is a folder from a LIST response.
+type MailboxInfo struct {
+	Name  string
+	Delim string
+	Attrs map[string]bool
+}
+
+// MailboxStatus describes a folder. Only the fields the server sent are set.
+type MailboxStatus struct {
+	Name        string
+	ReadOnly    bool
+	Messages    uint32
+	UIDNext     uint32
+	UIDValidity uint32
+}
+
+// SearchCriteria narrows down a UID SEARCH. The zero value matches every message.
+type SearchCriteria struct {
+	// UIDs only matches the messages with the given UIDs.
+	UIDs SeqSet
+	// Header and Value match messages whose Header contains Value.
+	Header string
+	Value  string
+}
+
+// Message is a message from a FETCH response. Only the items that were fetched are set.
+type Message struct {
+	Seq          uint32
+	UID          uint32
+	Flags        []string
+	InternalDate time.Time
+	Size         uint32
+	// Header is RFC822.HEADER or a BODY[HEADER...] item.
+	Header []byte
+	// Body is BODY[].
+	Body []byte
+}
+
+// UpdateType tells what a server sent during an IDLE.
+type UpdateType int
+
+const (
+	// ExistsUpdate is an EXISTS response with the new number of messages.
+	ExistsUpdate UpdateType = iota
+	// ExpungeUpdate is an EXPUNGE response with the sequence number of the removed message.
+	ExpungeUpdate
+	// FlagsUpdate is a FETCH response with a message's new flags.
+	FlagsUpdate
+)
+
+type Update struct {
+	Type UpdateType
+	// Num is the message count for an ExistsUpdate and the sequence number for an ExpungeUpdate.
+	Num uint32
+	// Message is set for a FlagsUpdate. It has the message's flags, sequence number and, if
+	// the server sent it, UID.
+	Message *Message
+}
+
+// SASL is an authentication mechanism for Session.Authenticate.
+type SASL interface {
+	// Start returns the mechanism's name and its initial response, if any.
+	Start() (mech string, ir []byte, err error)
+	// Next answers a challenge from the server.
+	Next(challenge []byte) (response []byte, err error)
+}
+
+var (
+	errNoData      = errors.New("no data returned!")
+	errIdleStopped = errors.New("idle stopped")
+	errUnsupported = errors.New("not supported by this IMAP client")
+	errNoUIDs      = errors.New("no UIDs given")
+)
+
+// SeqSet is a set of sequence numbers or UIDs made up of ranges like '3,5:7,12'.
+// A range with a Stop of 0 runs to the last message ('*').
+type SeqSet []SeqRange
+
+type SeqRange struct {
+	Start uint32
+	Stop  uint32
+}
+
+// NewSeqSet returns a set holding the given numbers.
+func NewSeqSet(nums ...uint32) SeqSet {
+	var set SeqSet
+	for _, num := range nums {
+		set.AddNum(num)
+	}
+	return set
+}
+
+// ParseSeqSet reads a set like '3,5:7,12'.
+func ParseSeqSet(set string) (SeqSet, error) {
+	var seqs SeqSet
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		start, err := parseSeqNum(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid sequence set %q", set)
+		}
+
+		stop := start
+		if len(bounds) == 2 {
+			if stop, err = parseSeqNum(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid sequence set %q", set)
+			}
+		}
+		seqs.AddRange(start, stop)
+	}
+	return seqs, nil
+}
+
+func parseSeqNum(num string) (uint32, error) {
+	if num == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(num, 10, 32)
+	if (err == nil) && (n == 0) {
+		err = errors.New("sequence numbers start at 1")
+	}
+	return uint32(n), err
+}
+
+// AddNum puts a single number in the set, extending the last range if it follows on from it.
+func (s *SeqSet) AddNum(num uint32) {
+	if last := len(*s) - 1; (last >= 0) && ((*s)[last].Stop != 0) && ((*s)[last].Stop+1 == num) {
+		(*s)[last].Stop = num
+		return
+	}
+	*s = append(*s, SeqRange{Start: num, Stop: num})
+}
+
+// AddRange puts start:stop in the set. A stop of 0 means '*'.
+func (s *SeqSet) AddRange(start uint32, stop uint32) {
+	if (start == 0) || ((stop != 0) && (stop < start)) {
+		start, stop = stop, start
+	}
+	*s = append(*s, SeqRange{Start: start, Stop: stop})
+}
+
+func (s SeqSet) Contains(num uint32) bool {
+	for _, r := range s {
+		if (r.Stop == 0) && (num >= r.Start) {
+			return true
+		}
+		if (num >= r.Start) && (num <= r.Stop) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s SeqSet) Empty() bool {
+	return len(s) == 0
+}
+
+func (s SeqSet) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = formatSeqNum(r.Start)
+		if r.Stop != r.Start {
+			parts[i] += ":" + formatSeqNum(r.Stop)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatSeqNum(num uint32) string {
+	if num == 0 {
+		return "*"
+	}
+	return strconv.FormatUint(uint64(num), 10)
+}
@@ -0,0 +1,421 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// emersionSession is a Session using github.com/emersion/go-imap. It doesn't do
+// CONDSTORE or QRESYNC so every sync looks for new messages by UID.
+type emersionSession struct {
+	client *client.Client
+	// caps is loaded on first use and again after STARTTLS and logging in.
+	caps map[string]bool
+
+	mu      sync.Mutex
+	updates []Update
+
+	// stopIdle ends the running IDLE and its result comes back on idleDone.
+	stopIdle chan struct{}
+	idleDone chan error
+}
+
+func newEmersionSession(conn net.Conn, timeout time.Duration) (Session, error) {
+	// the client has no timeout for the greeting so set one on the connection
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := client.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := &emersionSession{client: c}
+	updates := make(chan client.Update, 100)
+	c.Updates = updates
+	go s.collect(updates)
+	return s, nil
+}
+
+// collect holds on to the server's unsolicited responses until Updates is called. The
+// client stops reading if nothing takes them off its channel. EXISTS responses are left
+// to the idle's handler since the client's mailbox status is only safe to read there.
+func (s *emersionSession) collect(updates chan client.Update) {
+	for {
+		var update client.Update
+		select {
+		case update = <-updates:
+		case <-s.client.LoggedOut():
+			return
+		}
+
+		s.mu.Lock()
+		switch u := update.(type) {
+		case *client.ExpungeUpdate:
+			s.updates = append(s.updates, Update{Type: ExpungeUpdate, Num: u.SeqNum})
+		case *client.MessageUpdate:
+			if u.Message.Flags != nil {
+				s.updates = append(s.updates, Update{Type: FlagsUpdate, Message: emersionMessage(u.Message)})
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *emersionSession) Caps() map[string]bool {
+	if s.caps == nil {
+		if err := s.loadCaps(); err != nil {
+			log.Printf("Unable to get capabilities: %s", err.Error())
+		}
+	}
+	return s.caps
+}
+
+// loadCaps asks the server for its capabilities, which can change after STARTTLS and logging in.
+func (s *emersionSession) loadCaps() (err error) {
+	s.caps, err = s.client.Capability()
+	return err
+}
+
+func (s *emersionSession) StartTLS(config *tls.Config) error {
+	if err := s.client.StartTLS(config); err != nil {
+		return err
+	}
+	return s.loadCaps()
+}
+
+func (s *emersionSession) Login(user string, pw string) error {
+	if err := s.client.Login(user, pw); err != nil {
+		return err
+	}
+	return s.loadCaps()
+}
+
+func (s *emersionSession) Authenticate(auth SASL) error {
+	if err := s.client.Authenticate(auth); err != nil {
+		return err
+	}
+	return s.loadCaps()
+}
+
+func (s *emersionSession) Noop() error {
+	return s.client.Noop()
+}
+
+func (s *emersionSession) Logout(timeout time.Duration) error {
+	s.client.Timeout = timeout
+	err := s.client.Logout()
+	if err != nil {
+		s.client.Terminate()
+	}
+	return err
+}
+
+func (s *emersionSession) Closed() bool {
+	select {
+	case <-s.client.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *emersionSession) List(ref string, pattern string) ([]MailboxInfo, error) {
+	mboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.client.List(ref, pattern, mboxes)
+	}()
+
+	var infos []MailboxInfo
+	for mbox := range mboxes {
+		attrs := make(map[string]bool)
+		for _, attr := range mbox.Attributes {
+			attrs[attr] = true
+		}
+		infos = append(infos, MailboxInfo{Name: mbox.Name, Delim: mbox.Delimiter, Attrs: attrs})
+	}
+	return infos, <-done
+}
+
+func (s *emersionSession) Create(folder string) error {
+	return s.client.Create(folder)
+}
+
+func (s *emersionSession) Select(folder string, readOnly bool) error {
+	_, err := s.client.Select(folder, readOnly)
+	return err
+}
+
+func (s *emersionSession) Selected() *MailboxStatus {
+	mbox := s.client.Mailbox()
+	if mbox == nil {
+		return nil
+	}
+	return emersionStatus(mbox)
+}
+
+func (s *emersionSession) Status(folder string) (*MailboxStatus, error) {
+	mbox, err := s.client.Status(folder, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity})
+	if err != nil {
+		return nil, err
+	}
+	return emersionStatus(mbox), nil
+}
+
+func (s *emersionSession) Search(criteria SearchCriteria) ([]uint32, error) {
+	search := imap.NewSearchCriteria()
+	if !criteria.UIDs.Empty() {
+		search.Uid = emersionSeqSet(criteria.UIDs)
+	}
+	if len(criteria.Header) > 0 {
+		search.Header.Add(criteria.Header, criteria.Value)
+	}
+	return s.client.UidSearch(search)
+}
+
+func (s *emersionSession) Fetch(seqs SeqSet, items ...string) ([]*Message, error) {
+	return s.fetch(false, seqs, items)
+}
+
+func (s *emersionSession) UIDFetch(uids SeqSet, items ...string) ([]*Message, error) {
+	return s.fetch(true, uids, items)
+}
+
+func (s *emersionSession) fetch(uid bool, set SeqSet, items []string) ([]*Message, error) {
+	fetchItems := make([]imap.FetchItem, len(items))
+	for i, item := range items {
+		fetchItems[i] = imap.FetchItem(strings.ToUpper(item))
+	}
+
+	msgs := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		if uid {
+			done <- s.client.UidFetch(emersionSeqSet(set), fetchItems, msgs)
+		} else {
+			done <- s.client.Fetch(emersionSeqSet(set), fetchItems, msgs)
+		}
+	}()
+
+	var fetched []*Message
+	for msg := range msgs {
+		fetched = append(fetched, emersionMessage(msg))
+	}
+	return fetched, <-done
+}
+
+func (s *emersionSession) StoreFlags(uids SeqSet, add bool, flags ...string) error {
+	var op imap.FlagsOp = imap.RemoveFlags
+	if add {
+		op = imap.AddFlags
+	}
+	values := make([]interface{}, len(flags))
+	for i, flag := range flags {
+		values[i] = flag
+	}
+	return s.client.UidStore(emersionSeqSet(uids), imap.FormatFlagsOp(op, true), values, nil)
+}
+
+func (s *emersionSession) Copy(uids SeqSet, folder string) error {
+	return s.client.UidCopy(emersionSeqSet(uids), folder)
+}
+
+// Move needs the server to support MOVE (RFC 6851). The client's own fallback ends
+// with a plain EXPUNGE so it's never used.
+func (s *emersionSession) Move(uids SeqSet, folder string) error {
+	if !s.Caps()["MOVE"] {
+		return errUnsupported
+	}
+	return s.client.UidMove(emersionSeqSet(uids), folder)
+}
+
+func (s *emersionSession) Expunge(uids SeqSet) error {
+	if uids.Empty() {
+		return errNoUIDs
+	}
+
+	// the client doesn't know about UID EXPUNGE (RFC 4315)
+	cmd := &imap.Command{Name: "UID EXPUNGE", Arguments: []interface{}{emersionSeqSet(uids)}}
+	status, err := s.client.Execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func (s *emersionSession) Append(folder string, flags []string, date time.Time, body []byte) (uint32, error) {
+	// the client throws away the APPENDUID so send the command ourselves
+	cmd := &commands.Append{Mailbox: folder, Flags: flags, Date: date, Message: bytes.NewBuffer(body)}
+	status, err := s.client.Execute(cmd, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// look for the [APPENDUID <uidvalidity> <uid>] response code
+	if (status.Code != "APPENDUID") || (len(status.Arguments) == 0) {
+		return 0, nil
+	}
+	uid, _ := imap.ParseNumber(status.Arguments[len(status.Arguments)-1])
+	return uid, nil
+}
+
+// Idle runs the IDLE command itself rather than through the client so the EXISTS
+// responses can be picked up as they're read. Servers without IDLE get a NOOP every
+// minute instead.
+func (s *emersionSession) Idle() error {
+	supported := s.Caps()["IDLE"]
+	s.stopIdle = make(chan struct{})
+	s.idleDone = make(chan error, 1)
+	go func(stop chan struct{}, done chan error) {
+		if !supported {
+			done <- s.noopIdle(stop)
+			return
+		}
+		idle := &responses.Idle{Stop: stop, RepliesCh: make(chan []byte, 10)}
+		done <- s.execute(&commands.Idle{}, emersionIdle{idle: idle, s: s})
+	}(s.stopIdle, s.idleDone)
+	return nil
+}
+
+func (s *emersionSession) noopIdle(stop chan struct{}) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.execute(&commands.Noop{}, emersionIdle{s: s}); err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		case <-s.client.LoggedOut():
+			return errIdleStopped
+		}
+	}
+}
+
+func (s *emersionSession) execute(cmd imap.Commander, h responses.Handler) error {
+	status, err := s.client.Execute(cmd, h)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func (s *emersionSession) Updates() ([]Update, error) {
+	// an IDLE only finishes on its own if something went wrong
+	if s.idleDone != nil {
+		select {
+		case err := <-s.idleDone:
+			s.stopIdle, s.idleDone = nil, nil
+			if err == nil {
+				err = errIdleStopped
+			}
+			return nil, err
+		default:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updates := s.updates
+	s.updates = nil
+	return updates, nil
+}
+
+func (s *emersionSession) IdleTerm() error {
+	if s.stopIdle == nil {
+		return nil
+	}
+	close(s.stopIdle)
+	err := <-s.idleDone
+	s.stopIdle, s.idleDone = nil, nil
+	return err
+}
+
+// emersionIdle copies the message count out of each EXISTS response while the client's
+// reader is handling it and then lets the client have it as well.
+type emersionIdle struct {
+	idle *responses.Idle
+	s    *emersionSession
+}
+
+func (h emersionIdle) Replies() <-chan []byte {
+	if h.idle == nil {
+		return nil
+	}
+	return h.idle.Replies()
+}
+
+func (h emersionIdle) Handle(resp imap.Resp) error {
+	if h.idle != nil {
+		if err := h.idle.Handle(resp); err != responses.ErrUnhandled {
+			return err
+		}
+	}
+
+	if name, fields, ok := imap.ParseNamedResp(resp); ok && (name == "EXISTS") && (len(fields) > 0) {
+		if num, err := imap.ParseNumber(fields[0]); err == nil {
+			h.s.mu.Lock()
+			h.s.updates = append(h.s.updates, Update{Type: ExistsUpdate, Num: num})
+			h.s.mu.Unlock()
+		}
+	}
+	return responses.ErrUnhandled
+}
+
+func emersionSeqSet(set SeqSet) *imap.SeqSet {
+	seqSet, _ := imap.ParseSeqSet(set.String())
+	return seqSet
+}
+
+func emersionStatus(mbox *imap.MailboxStatus) *MailboxStatus {
+	return &MailboxStatus{
+		Name:        mbox.Name,
+		ReadOnly:    mbox.ReadOnly,
+		Messages:    mbox.Messages,
+		UIDNext:     mbox.UidNext,
+		UIDValidity: mbox.UidValidity,
+	}
+}
+
+func emersionMessage(msg *imap.Message) *Message {
+	m := &Message{
+		Seq:          msg.SeqNum,
+		UID:          msg.Uid,
+		InternalDate: msg.InternalDate,
+		Size:         msg.Size,
+	}
+	if msg.Flags != nil {
+		m.Flags = append([]string{}, msg.Flags...)
+	}
+
+	for section, literal := range msg.Body {
+		if literal == nil {
+			continue
+		}
+		data, _ := ioutil.ReadAll(literal)
+		switch {
+		case section.Specifier == imap.HeaderSpecifier:
+			m.Header = data
+		case (section.Specifier == imap.EntireSpecifier) && (len(section.Path) == 0):
+			m.Body = data
+		}
+	}
+	return m
+}
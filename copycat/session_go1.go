@@ -0,0 +1,392 @@
+package copycat
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// go1Session is a Session using code.google.com/p/go-imap.
+type go1Session struct {
+	client *imap.Client
+}
+
+func newGo1Session(conn net.Conn, host string, timeout time.Duration) (Session, error) {
+	client, err := imap.NewClient(conn, host, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &go1Session{client: client}, nil
+}
+
+func (s *go1Session) Caps() map[string]bool {
+	// most servers list their capabilities in the greeting but make sure
+	if len(s.client.Caps) == 0 {
+		if _, err := imap.Wait(s.client.Capability()); err != nil {
+			log.Printf("Unable to get capabilities: %s", err.Error())
+		}
+	}
+	return s.client.Caps
+}
+
+func (s *go1Session) StartTLS(config *tls.Config) error {
+	_, err := s.client.StartTLS(config)
+	return err
+}
+
+func (s *go1Session) Login(user string, pw string) error {
+	_, err := s.client.Login(user, pw)
+	return err
+}
+
+func (s *go1Session) Authenticate(auth SASL) error {
+	_, err := s.client.Auth(go1SASL{auth})
+	return err
+}
+
+func (s *go1Session) Noop() error {
+	_, err := imap.Wait(s.client.Noop())
+	return err
+}
+
+func (s *go1Session) Logout(timeout time.Duration) error {
+	_, err := s.client.Logout(timeout)
+	return err
+}
+
+func (s *go1Session) Closed() bool {
+	// Closed is the zero state so it can't be masked
+	state := s.client.State()
+	return (state == imap.Closed) || (state == imap.Logout)
+}
+
+func (s *go1Session) List(ref string, pattern string) ([]MailboxInfo, error) {
+	cmd, err := imap.Wait(s.client.List(ref, pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []MailboxInfo
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil {
+			infos = append(infos, MailboxInfo{Name: info.Name, Delim: info.Delim, Attrs: info.Attrs})
+		}
+	}
+	return infos, nil
+}
+
+func (s *go1Session) Create(folder string) error {
+	_, err := imap.Wait(s.client.Create(folder))
+	return err
+}
+
+func (s *go1Session) Select(folder string, readOnly bool) error {
+	_, err := imap.Wait(s.client.Select(folder, readOnly))
+	return err
+}
+
+func (s *go1Session) Selected() *MailboxStatus {
+	mbox := s.client.Mailbox
+	if mbox == nil {
+		return nil
+	}
+	return &MailboxStatus{
+		Name:        mbox.Name,
+		ReadOnly:    mbox.ReadOnly,
+		Messages:    mbox.Messages,
+		UIDNext:     mbox.UIDNext,
+		UIDValidity: mbox.UIDValidity,
+	}
+}
+
+func (s *go1Session) Status(folder string) (*MailboxStatus, error) {
+	cmd, err := imap.Wait(s.client.Status(folder, "MESSAGES", "UIDNEXT", "UIDVALIDITY"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rsp := range cmd.Data {
+		if status := rsp.MailboxStatus(); status != nil {
+			return &MailboxStatus{
+				Name:        status.Name,
+				Messages:    status.Messages,
+				UIDNext:     status.UIDNext,
+				UIDValidity: status.UIDValidity,
+			}, nil
+		}
+	}
+	return nil, errNoData
+}
+
+func (s *go1Session) Search(criteria SearchCriteria) ([]uint32, error) {
+	var spec []imap.Field
+	if !criteria.UIDs.Empty() {
+		spec = append(spec, "UID", go1SeqSet(criteria.UIDs))
+	}
+	if len(criteria.Header) > 0 {
+		spec = append(spec, "HEADER", criteria.Header, criteria.Value)
+	}
+	if len(spec) == 0 {
+		spec = []imap.Field{"ALL"}
+	}
+
+	cmd, err := imap.Wait(s.client.UIDSearch(spec...))
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, rsp := range cmd.Data {
+		uids = append(uids, rsp.SearchResults()...)
+	}
+	return uids, nil
+}
+
+func (s *go1Session) Fetch(seqs SeqSet, items ...string) ([]*Message, error) {
+	return go1Messages(imap.Wait(s.client.Fetch(go1SeqSet(seqs), items...)))
+}
+
+func (s *go1Session) UIDFetch(uids SeqSet, items ...string) ([]*Message, error) {
+	return go1Messages(imap.Wait(s.client.UIDFetch(go1SeqSet(uids), items...)))
+}
+
+func (s *go1Session) StoreFlags(uids SeqSet, add bool, flags ...string) error {
+	item := "-FLAGS.SILENT"
+	if add {
+		item = "+FLAGS.SILENT"
+	}
+	_, err := imap.Wait(s.client.UIDStore(go1SeqSet(uids), item, imap.NewFlagSet(flags...)))
+	return err
+}
+
+func (s *go1Session) Copy(uids SeqSet, folder string) error {
+	_, err := imap.Wait(s.client.UIDCopy(go1SeqSet(uids), folder))
+	return err
+}
+
+// Move needs the server to support MOVE (RFC 6851).
+func (s *go1Session) Move(uids SeqSet, folder string) error {
+	if !s.Caps()["MOVE"] {
+		return errUnsupported
+	}
+	_, err := imap.Wait(s.client.Send("UID MOVE", go1SeqSet(uids), s.client.Quote(imap.UTF7Encode(folder))))
+	return err
+}
+
+func (s *go1Session) Expunge(uids SeqSet) error {
+	if uids.Empty() {
+		return errNoUIDs
+	}
+	_, err := imap.Wait(s.client.Expunge(go1SeqSet(uids)))
+	return err
+}
+
+func (s *go1Session) Append(folder string, flags []string, date time.Time, body []byte) (uint32, error) {
+	cmd, err := imap.Wait(s.client.Append(folder, imap.NewFlagSet(flags...), &date, imap.NewLiteral(body)))
+	if err != nil {
+		return 0, err
+	}
+
+	// look for the [APPENDUID <uidvalidity> <uid>] response code
+	rsp, err := cmd.Result(imap.OK)
+	if (err != nil) || (rsp.Label != "APPENDUID") || (len(rsp.Fields) == 0) {
+		return 0, nil
+	}
+	return imap.AsNumber(rsp.Fields[len(rsp.Fields)-1]), nil
+}
+
+func (s *go1Session) Idle() error {
+	_, err := s.client.Idle()
+	if err == imap.ErrTimeout {
+		return nil
+	}
+	return err
+}
+
+func (s *go1Session) Updates() ([]Update, error) {
+	if err := s.client.Recv(0); (err != nil) && (err != imap.ErrTimeout) {
+		return nil, err
+	}
+
+	// take the data so it isn't handled twice while starting/stopping the idle
+	data := s.client.Data
+	s.client.Data = nil
+
+	var updates []Update
+	for _, rsp := range data {
+		if rsp.Type != imap.Data {
+			continue
+		}
+
+		// len of 2 likely means its an EXPUNGE or EXISTS command...
+		if len(rsp.Fields) == 2 {
+			num := imap.AsNumber(rsp.Fields[0])
+			switch rsp.Fields[1] {
+			case "EXPUNGE":
+				updates = append(updates, Update{Type: ExpungeUpdate, Num: num})
+			case "EXISTS":
+				updates = append(updates, Update{Type: ExistsUpdate, Num: num})
+			}
+		} else if (len(rsp.Fields) == 3) && (rsp.Fields[1] == "FETCH") {
+			// a FETCH with FLAGS means a message's flags were changed by someone
+			if info := rsp.MessageInfo(); (info != nil) && (info.Flags != nil) {
+				updates = append(updates, Update{Type: FlagsUpdate, Message: go1Message(info)})
+			}
+		}
+	}
+	return updates, nil
+}
+
+func (s *go1Session) IdleTerm() error {
+	_, err := s.client.IdleTerm()
+	return err
+}
+
+func (s *go1Session) Enable(caps ...string) error {
+	fields := make([]imap.Field, len(caps))
+	for i, c := range caps {
+		fields[i] = c
+	}
+	_, err := imap.Wait(s.client.Send("ENABLE", fields...))
+	return err
+}
+
+func (s *go1Session) HighestModSeq(folder string) (uint64, error) {
+	cmd, err := imap.Wait(s.client.Status(folder, "HIGHESTMODSEQ"))
+	if err != nil {
+		return 0, err
+	}
+
+	// go-imap doesn't know about HIGHESTMODSEQ so dig through the raw fields
+	for _, rsp := range cmd.Data {
+		if (rsp.Label != "STATUS") || (len(rsp.Fields) < 3) {
+			continue
+		}
+		items := imap.AsList(rsp.Fields[2])
+		for i := 0; i < len(items)-1; i += 2 {
+			if strings.EqualFold(imap.AsAtom(items[i]), "HIGHESTMODSEQ") {
+				return asModSeq(items[i+1]), nil
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// asModSeq handles mod-sequences that are too big to be parsed as a uint32.
+func asModSeq(f imap.Field) uint64 {
+	switch v := f.(type) {
+	case uint32:
+		return uint64(v)
+	case string:
+		modSeq, _ := strconv.ParseUint(v, 10, 64)
+		return modSeq
+	}
+	return 0
+}
+
+func (s *go1Session) FetchChangedSince(modSeq uint64, items ...string) ([]*Message, error) {
+	allMsgs, _ := imap.NewSeqSet("1:*")
+	fields := []imap.Field{"UID", "FLAGS"}
+	for _, item := range items {
+		fields = append(fields, item)
+	}
+	modifiers := []imap.Field{"CHANGEDSINCE", strconv.FormatUint(modSeq, 10)}
+	return go1Messages(imap.Wait(s.client.Send("UID FETCH", allMsgs, fields, modifiers)))
+}
+
+func (s *go1Session) VanishedSince(modSeq uint64) (SeqSet, error) {
+	allMsgs, _ := imap.NewSeqSet("1:*")
+	items := []imap.Field{"UID"}
+	modifiers := []imap.Field{"CHANGEDSINCE", strconv.FormatUint(modSeq, 10), "VANISHED"}
+	cmd, err := imap.Wait(s.client.Send("UID FETCH", allMsgs, items, modifiers))
+	if err != nil {
+		return nil, err
+	}
+
+	// VANISHED responses are unknown to go-imap so they may show up as unsolicited data
+	var vanished SeqSet
+	var unsolicited []*imap.Response
+	for _, rsp := range append(cmd.Data, s.client.Data...) {
+		if (rsp.Label != "VANISHED") || (len(rsp.Fields) < 2) {
+			continue
+		}
+
+		var set SeqSet
+		if set, err = ParseSeqSet(imap.AsAtom(rsp.Fields[len(rsp.Fields)-1])); err != nil {
+			return nil, err
+		}
+		vanished = append(vanished, set...)
+	}
+
+	// ...and clear them out so no one else trips over them
+	for _, rsp := range s.client.Data {
+		if rsp.Label != "VANISHED" {
+			unsolicited = append(unsolicited, rsp)
+		}
+	}
+	s.client.Data = unsolicited
+
+	return vanished, nil
+}
+
+func go1SeqSet(set SeqSet) *imap.SeqSet {
+	seqSet, _ := imap.NewSeqSet(set.String())
+	return seqSet
+}
+
+func go1Messages(cmd *imap.Command, err error) ([]*Message, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*Message
+	for _, rsp := range cmd.Data {
+		if info := rsp.MessageInfo(); info != nil {
+			msgs = append(msgs, go1Message(info))
+		}
+	}
+	return msgs, nil
+}
+
+func go1Message(info *imap.MessageInfo) *Message {
+	msg := &Message{
+		Seq:          info.Seq,
+		UID:          info.UID,
+		InternalDate: info.InternalDate,
+		Size:         info.Size,
+		Body:         imap.AsBytes(info.Attrs["BODY[]"]),
+	}
+	if info.Flags != nil {
+		msg.Flags = []string{}
+		for flag, set := range info.Flags {
+			if set {
+				msg.Flags = append(msg.Flags, flag)
+			}
+		}
+	}
+
+	// the header can come from either RFC822.HEADER or a BODY[HEADER.FIELDS (...)] item
+	for name, value := range info.Attrs {
+		if (name == "RFC822.HEADER") || strings.HasPrefix(name, "BODY[HEADER") {
+			msg.Header = imap.AsBytes(value)
+			break
+		}
+	}
+	return msg
+}
+
+// go1SASL lets go-imap use a SASL mechanism.
+type go1SASL struct {
+	SASL
+}
+
+func (a go1SASL) Start(s *imap.ServerInfo) (string, []byte, error) {
+	return a.SASL.Start()
+}
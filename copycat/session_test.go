@@ -0,0 +1,30 @@
+package copycat
+
+import "testing"
+
+func TestSeqSet(t *testing.T) {
+	set, err := ParseSeqSet("3,5:7,12:10,20:*")
+	if err != nil {
+		t.Errorf("unable to parse sequence set - %s", err.Error())
+		return
+	}
+	if expected := "3,5:7,10:12,20:*"; set.String() != expected {
+		t.Errorf("sequence set was %s - expected %s", set, expected)
+	}
+
+	for num, expected := range map[uint32]bool{3: true, 4: false, 6: true, 11: true, 13: false, 19: false, 500: true} {
+		if set.Contains(num) != expected {
+			t.Errorf("Contains(%d) returned %t - expected %t", num, !expected, expected)
+		}
+	}
+
+	if nums := NewSeqSet(1, 2, 3, 5); nums.String() != "1:3,5" {
+		t.Errorf("NewSeqSet(1, 2, 3, 5) was %s - expected 1:3,5", nums)
+	}
+
+	for _, bad := range []string{"", "0", "1:x", "a"} {
+		if _, err = ParseSeqSet(bad); err == nil {
+			t.Errorf("ParseSeqSet(%q) did not fail", bad)
+		}
+	}
+}
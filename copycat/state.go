@@ -0,0 +1,219 @@
+package copycat
+
+import (
+	"os"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// StateStore persists what has been synced for each source/destination folder pair
+// so later syncs only need to look at new messages. It lives alongside the Cache.
+type StateStore struct {
+	db *leveldb.DB
+	// readOnly stores ignore Puts.
+	readOnly bool
+}
+
+func NewStateStore(dbPath string) (*StateStore, error) {
+	s := &StateStore{}
+	var err error
+	s.db, err = leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openStateStore will open the state store for the cache at dbFile. A dry run only reads
+// it and starts from empty states if there isn't one yet so nothing is written.
+func openStateStore(dbFile string, plan *Plan) (*StateStore, error) {
+	if plan == nil {
+		return NewStateStore(stateFile(dbFile))
+	}
+
+	if _, err := os.Stat(stateFile(dbFile)); os.IsNotExist(err) {
+		return &StateStore{readOnly: true}, nil
+	}
+	db, err := leveldb.OpenFile(stateFile(dbFile), &opt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &StateStore{db: db, readOnly: true}, nil
+}
+
+func (s *StateStore) Close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// Get will return the state for the folder pair. If nothing has been
+// synced yet, an empty state is returned.
+func (s *StateStore) Get(key string) (*FolderState, error) {
+	state := &FolderState{}
+	if s.db == nil {
+		return state, nil
+	}
+	rawData, err := s.db.Get([]byte(key), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return state, nil
+		}
+		return state, err
+	}
+
+	if err = deserialize(rawData, state); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+func (s *StateStore) Put(key string, state *FolderState) error {
+	if s.readOnly {
+		return nil
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	rawData, err := serialize(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Put([]byte(key), rawData, nil)
+}
+
+// stateFile returns the location of the state store for the given cache location.
+func stateFile(dbFile string) string {
+	return dbFile + ".state"
+}
+
+// stateKey builds the key for a source folder and destination folder pair.
+func stateKey(srcFolder, dstUser, dstFolder string) string {
+	return srcFolder + "\x00" + dstUser + "\x00" + dstFolder
+}
+
+// FolderState holds the sync progress between a source folder and a destination folder.
+// A nil *FolderState is valid and will ignore any updates.
+type FolderState struct {
+	SrcUIDValidity uint32
+	DstUIDValidity uint32
+	// LastUID is the highest source UID that has been synced.
+	LastUID uint32
+	// HighestModSeq is the source's HIGHESTMODSEQ as of the last store.
+	HighestModSeq uint64
+	// PurgedModSeq is the source's HIGHESTMODSEQ as of the last purge.
+	PurgedModSeq uint64
+	// UIDs maps source UIDs to destination UIDs.
+	UIDs map[uint32]uint32
+	// SinceFlagScan counts the syncs since the flags of every message were compared.
+	SinceFlagScan int
+
+	mu     sync.Mutex
+	failed bool
+}
+
+// CheckValidity will compare the UIDVALIDITY values with the ones from the last sync.
+// If either has changed, the UIDs we know about are useless so the state is reset
+// to force a full resync. Returns true if the state was reset.
+func (f *FolderState) CheckValidity(srcUIDValidity, dstUIDValidity uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reset := false
+	if (f.SrcUIDValidity != srcUIDValidity) || (f.DstUIDValidity != dstUIDValidity) {
+		f.LastUID = 0
+		f.HighestModSeq = 0
+		f.PurgedModSeq = 0
+		f.UIDs = nil
+		f.SinceFlagScan = 0
+		reset = true
+	}
+
+	f.SrcUIDValidity = srcUIDValidity
+	f.DstUIDValidity = dstUIDValidity
+	return reset
+}
+
+// Record will save the destination UID for a source message.
+func (f *FolderState) Record(srcUID, dstUID uint32) {
+	if f == nil || dstUID == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.UIDs == nil {
+		f.UIDs = make(map[uint32]uint32)
+	}
+	f.UIDs[srcUID] = dstUID
+}
+
+// Lookup will find the destination UID for a source message.
+func (f *FolderState) Lookup(srcUID uint32) (uint32, bool) {
+	if f == nil {
+		return 0, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dstUID, ok := f.UIDs[srcUID]
+	return dstUID, ok
+}
+
+// Fail marks that a message could not be synced so LastUID will not be moved forward.
+func (f *FolderState) Fail() {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = true
+}
+
+// Failed returns true if a message could not be synced.
+func (f *FolderState) Failed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failed
+}
+
+// Complete will move LastUID up to lastUID and HighestModSeq up to modSeq
+// unless a message failed to sync.
+func (f *FolderState) Complete(lastUID uint32, modSeq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed {
+		return
+	}
+
+	if lastUID > f.LastUID {
+		f.LastUID = lastUID
+	}
+	f.HighestModSeq = modSeq
+}
+
+// FlagScanDue returns true if it has been more than interval syncs since the flags of
+// every message were compared. An interval of 0 means never.
+func (f *FolderState) FlagScanDue(interval int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return (interval > 0) && (f.SinceFlagScan >= interval)
+}
+
+// CountSync keeps track of the syncs since the last flag scan. scanned is true if
+// this sync compared every message. A scan that failed partway doesn't count.
+func (f *FolderState) CountSync(scanned bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if scanned && !f.failed {
+		f.SinceFlagScan = 0
+		return
+	}
+	f.SinceFlagScan++
+}
@@ -0,0 +1,62 @@
+package copycat
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+const stateTestLoc = "/tmp/statetest"
+
+func TestStateStore(t *testing.T) {
+	defer func() {
+		if err := os.RemoveAll(stateTestLoc); err != nil {
+			log.Print(err.Error())
+		}
+	}()
+
+	store, err := NewStateStore(stateTestLoc)
+	if err != nil {
+		t.Errorf("unable to create state store - %s", err.Error())
+		return
+	}
+	defer store.Close()
+
+	key := stateKey("INBOX", "dest1_user_name", "INBOX")
+	state, err := store.Get(key)
+	if err != nil {
+		t.Errorf("unable to get empty state - %s", err.Error())
+		return
+	}
+
+	state.CheckValidity(100, 200)
+	state.Record(1, 11)
+	state.Record(2, 12)
+	state.Complete(2, 0)
+	if err = store.Put(key, state); err != nil {
+		t.Errorf("unable to put state - %s", err.Error())
+		return
+	}
+
+	state, err = store.Get(key)
+	if err != nil {
+		t.Errorf("unable to get state - %s", err.Error())
+		return
+	}
+	if state.LastUID != 2 || state.UIDs[2] != 12 {
+		t.Errorf("state returned %d/%v - expected 2/map[1:11 2:12]", state.LastUID, state.UIDs)
+	}
+
+	if state.CheckValidity(100, 200) {
+		t.Errorf("state was reset with the same UIDVALIDITY")
+	}
+	if !state.CheckValidity(101, 200) || state.LastUID != 0 || len(state.UIDs) != 0 {
+		t.Errorf("state was not reset after UIDVALIDITY changed")
+	}
+
+	state.Fail()
+	state.Complete(5, 0)
+	if state.LastUID != 0 {
+		t.Errorf("failed state moved LastUID to %d", state.LastUID)
+	}
+}
@@ -1,81 +1,226 @@
 package copycat
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"log"
-	"net/mail"
 	"sync"
 	"time"
-
-	"code.google.com/p/go-imap/go1/imap"
 )
 
+// FlagScanInterval is how many syncs of a folder run between full flag scans when
+// the source doesn't support CONDSTORE. Otherwise flag changes on messages that were
+// already synced are never picked up. 0 turns the scans off.
+var FlagScanInterval = 10
+
+// errStoreIncomplete is returned by SearchAndStore when some messages couldn't be stored.
+var errStoreIncomplete = errors.New("some messages could not be stored. they will be tried again on the next sync")
+
 // SearchAndStore will check check if each message in the source inbox
 // exists in the destinations. If it doesn't exist in a destination, the message info will
-// be pulled and stored into the destination.
-func SearchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, dbFile string, quickSyncCount int) (err error) {
-	var cmd *imap.Command
-	cmd, err = GetAllMessages(src[0])
+// be pulled from the cache or the source and stored into the destination. The sync state
+// kept next to dbFile is used to only look at messages that have arrived since the last
+// sync, plus a full flag scan every FlagScanInterval syncs if the source doesn't support
+// CONDSTORE. Messages are matched up between the inboxes and stored in the cache using the
+// given identity. If ctx is done, no more requests are handed out and SearchAndStore returns
+// once the workers finish what they have, without moving the sync state forward. Any
+// messages that couldn't be stored also hold the state back and an error is returned.
+// If plan is not nil, the work is recorded in it instead and the state is left alone.
+func SearchAndStore(ctx context.Context, src []Session, dsts map[string][]Session, cache MessageCache, dbFile string, quickSyncCount int, identity Identity, plan *Plan) (err error) {
+	// load up what we know from previous syncs
+	stateStore, err := openStateStore(dbFile, plan)
 	if err != nil {
-		log.Printf("Unable to get all messages!")
+		log.Printf("problems initiating sync state - %s", err.Error())
 		return
 	}
+	defer stateStore.Close()
+
+	// grab the mod-sequence before looking at anything so nothing slips by
+	var highestModSeq uint64
+	if highestModSeq, err = getHighestModSeq(src[0]); err != nil {
+		log.Printf("Unable to get HIGHESTMODSEQ: %s", err.Error())
+		highestModSeq = 0
+	}
 
-	// connect to cache
-	cache, err := NewCache(dbFile)
+	// the destinations are always walked in the same order so they line up with their states
+	srcMailbox := src[0].Selected()
+	users := sortedUsers(dsts)
+	var stateKeys []string
+	var states []*FolderState
+	var lastUID uint32
+	var modSeq uint64
+	for _, user := range users {
+		dstMailbox := dsts[user][0].Selected()
+		key := stateKey(srcMailbox.Name, user, dstMailbox.Name)
+		var state *FolderState
+		if state, err = stateStore.Get(key); err != nil {
+			log.Printf("problems loading sync state for %s - %s", user, err.Error())
+			return
+		}
+		// CheckValidity clears LastUID so check if anything had been synced first
+		synced := state.LastUID > 0
+		if state.CheckValidity(srcMailbox.UIDValidity, dstMailbox.UIDValidity) && synced {
+			log.Printf("UIDVALIDITY changed for %s. running a full resync", user)
+		}
+
+		if (len(states) == 0) || (state.LastUID < lastUID) {
+			lastUID = state.LastUID
+		}
+		if (len(states) == 0) || (state.HighestModSeq < modSeq) {
+			modSeq = state.HighestModSeq
+		}
+		stateKeys = append(stateKeys, key)
+		states = append(states, state)
+	}
+
+	// with CONDSTORE we can also pick up flag changes on messages we've already synced.
+	// without it, destinations are scanned and diffed every so often to catch them.
+	changedOnly := (highestModSeq > 0) && (modSeq > 0)
+	fullScans := make([]bool, len(states))
+	for i, state := range states {
+		fullScans[i] = state.LastUID == 0
+		if !changedOnly && (quickSyncCount == 0) && state.FlagScanDue(FlagScanInterval) {
+			log.Printf("running a full flag scan of %s for %s", srcMailbox.Name, users[i])
+			fullScans[i] = true
+			lastUID = 0
+		}
+	}
+	var changed []scannedMessage
+	var uids []uint32
+	if changedOnly {
+		log.Printf("looking for messages changed since mod-sequence %d", modSeq)
+		var msgs []*Message
+		if msgs, err = GetMessagesChangedSince(src[0], modSeq, identity.FetchItems()...); err == nil {
+			countFetched(src[0], msgs)
+			changed = scanResponses(identity, msgs)
+		}
+	} else {
+		uids, err = listUIDs(src[0], lastUID)
+	}
 	if err != nil {
-		log.Printf("problems initiating cache - %s", err.Error())
+		log.Printf("Unable to get all messages!")
 		return
 	}
-	defer cache.Close()
 
-	// setup message fetchers to pull from the source/memcache
-	fetchRequests := make(chan fetchRequest)
-	for _, srcConn := range src {
-		go fetchEmails(srcConn, fetchRequests, cache)
+	// consider quick sync
+	quickSync := (quickSyncCount != 0) && (quickSyncCount < len(uids))
+	if quickSync {
+		log.Printf("found quick sync count. will only sync the last %d of %d messages", quickSyncCount, len(uids))
+		uids = uids[len(uids)-quickSyncCount:]
+	}
+
+	// destinations that need a full sync are scanned up front and diffed
+	// in memory instead of searching for every source message. a dry run
+	// scans them all so it can tell what the storers would find.
+	var indexes []*messageIndex
+	var dstIndexes []*folderIndex
+	for i, user := range users {
+		index := newMessageIndex(identity)
+		var dstIndex *folderIndex
+		if fullScans[i] || (plan != nil) {
+			if dstIndex, err = index.Build(ctx, dsts[user][0]); err != nil {
+				log.Printf("Unable to scan destination messages for %s: %s", user, err.Error())
+				return
+			}
+		}
+		indexes = append(indexes, index)
+		dstIndexes = append(dstIndexes, dstIndex)
 	}
 
+	// page through the source in the background while the workers run. the
+	// first connection is busy paging so the fetchers get the rest.
+	var srcMsgs chan scannedMessage
+	scanErrs := make(chan error, 1)
+	fetchConns := src
+	if changedOnly {
+		srcMsgs = sendMessages(changed)
+		scanErrs <- nil
+	} else {
+		srcMsgs, scanErrs = scanMessages(ctx, src[0], identity, uids)
+		if len(src) > 1 {
+			fetchConns = src[1:]
+		} else {
+			srcMsgs = bufferMessages(srcMsgs)
+		}
+	}
+
+	// setup message fetchers to pull from the source/cache
+	fetchRequests := make(chan fetchRequest)
 	var appendRequests []chan WorkRequest
 	var storers sync.WaitGroup
-	// setup storers for each destination
-	for _, dst := range dsts {
-		storeRequests := make(chan WorkRequest)
-		for _, dstConn := range dst {
-			storers.Add(1)
-			go CheckAndAppendMessages(dstConn, storeRequests, fetchRequests, &storers)
+	if plan == nil {
+		for _, srcConn := range fetchConns {
+			go fetchEmails(ctx, srcConn, fetchRequests, cache)
+		}
+
+		// setup storers for each destination
+		for i, user := range users {
+			storeRequests := make(chan WorkRequest)
+			for _, dstConn := range dsts[user] {
+				storers.Add(1)
+				go CheckAndAppendMessages(ctx, dstConn, storeRequests, fetchRequests, states[i], indexes[i], &storers)
+			}
+			appendRequests = append(appendRequests, storeRequests)
 		}
-		appendRequests = append(appendRequests, storeRequests)
 	}
 
 	// build the requests and send them
-	log.Printf("store processing for %d messages from the source inbox", len(cmd.Data))
-	var rsp *imap.Response
-	var indx int
+	log.Printf("store processing for %d messages from the source inbox", len(uids)+len(changed))
+	var maxUID uint32
 	startTime := time.Now()
-	syncStart := 0
-	// consider quick sync
-	if quickSyncCount != 0 {
-		syncStart = len(cmd.Data) - quickSyncCount
-		log.Printf("found quick sync count. will only sync messages %d through %d", syncStart, len(cmd.Data))
-	}
-	for indx, rsp = range cmd.Data[syncStart:] {
-		header := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.HEADER"])
-		if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
-			header := "Message-Id"
-			value := msg.Header.Get(header)
-
-			// create the store request and pass it to each dst's storers
-			storeRequest := WorkRequest{Value: value, Header: header, UID: rsp.MessageInfo().UID}
-			for _, storeRequests := range appendRequests {
+	indx := 0
+	for msg := range srcMsgs {
+		// keep draining so the scanner can wind down, but stop handing out work
+		if ctx.Err() != nil {
+			continue
+		}
+
+		// create the store request and pass it to each dst's storers. messages
+		// they have already seen only need their flags updated.
+		storeRequest := WorkRequest{Value: msg.Key, Header: msg.Header, UID: msg.UID, Flags: msg.Flags}
+		if plan != nil {
+			for i, user := range users {
+				planStore(plan, user, dsts[user][0].Selected().Name, msg, indexes[i], dstIndexes[i], states[i], changedOnly || fullScans[i])
+			}
+		}
+		for i, storeRequests := range appendRequests {
+			switch {
+			case dstIndexes[i] != nil:
+				// we know exactly what the destination has, only send what's needed. a flag
+				// scan leaves synced messages that have since been removed alone.
+				request, ok := indexes[i].diff(msg, dstIndexes[i], states[i])
+				if ok && ((request.Type == FlagWork) || (msg.UID > states[i].LastUID)) {
+					storeRequests <- request
+				}
+			case storeRequest.UID > states[i].LastUID:
 				storeRequests <- storeRequest
+			case changedOnly:
+				flagRequest := storeRequest
+				flagRequest.Type = FlagWork
+				storeRequests <- flagRequest
 			}
+		}
+		if storeRequest.UID > maxUID {
+			maxUID = storeRequest.UID
+		}
 
-			if ((indx % 100) == 0) && (indx > 0) {
-				since := time.Since(startTime)
-				rate := 100 / since.Seconds()
-				startTime = time.Now()
-				log.Printf("Completed store processing for %d messages from the source inbox. Rate: %f msg/s", indx, rate)
-			}
+		if ((indx % 100) == 0) && (indx > 0) {
+			since := time.Since(startTime)
+			rate := 100 / since.Seconds()
+			startTime = time.Now()
+			log.Printf("Completed store processing for %d messages from the source inbox. Rate: %f msg/s", indx, rate)
+		}
+		indx++
+	}
+	// if we couldn't page through everything, the state can't move past it
+	scanErr := <-scanErrs
+	if scanErr == nil {
+		scanErr = ctx.Err()
+	}
+	if scanErr != nil {
+		log.Printf("Unable to get all messages: %s", scanErr.Error())
+		for _, state := range states {
+			state.Fail()
 		}
 	}
 
@@ -89,19 +234,43 @@ func SearchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, dbFile s
 	// once the storers are complete we can close the fetch channel
 	close(fetchRequests)
 
+	// save our progress. a quick sync skips older messages so it can't move LastUID.
+	var incomplete bool
+	for i, state := range states {
+		incomplete = incomplete || state.Failed()
+		if !quickSync {
+			state.Complete(maxUID, highestModSeq)
+		}
+		state.CountSync(fullScans[i])
+		if err = stateStore.Put(stateKeys[i], state); err != nil {
+			log.Printf("Unable to save sync state: %s", err.Error())
+		}
+	}
+
 	log.Printf("search and store processes complete")
+	if scanErr != nil {
+		return scanErr
+	}
+	if incomplete {
+		return errStoreIncomplete
+	}
 	return nil
 }
 
 // checkAndStoreMessages will wait for WorkRequests to come acorss the pipe. When it receives a request, it will search
 // the given destination inbox for the message. If it is not found, this method will attempt to pull the messages data
 // from fetchRequests and then append it to the destination.
-func CheckAndAppendMessages(dstConn *imap.Client, storeRequests chan WorkRequest, fetchRequests chan fetchRequest, wg *sync.WaitGroup) {
+// Each message that is found or appended is recorded in the state, which may be nil. Requests
+// without a searchable header are looked up in the index. If the connection drops, it
+// is brought back and the request is tried again.
+func CheckAndAppendMessages(ctx context.Context, dstConn Session, storeRequests chan WorkRequest, fetchRequests chan fetchRequest, state *FolderState, index *messageIndex, wg *sync.WaitGroup) {
 	defer wg.Done()
+	conn := &liveConn{Session: current(dstConn)}
 
 	// noop it every few to keep things alive
 	timeout := time.NewTicker(NoopMinutes * time.Minute)
 	done := false
+	var delim string
 	for {
 		select {
 		case request, ok := <-storeRequests:
@@ -109,21 +278,71 @@ func CheckAndAppendMessages(dstConn *imap.Client, storeRequests chan WorkRequest
 				done = true
 				break
 			}
-			// search for in dst
-			cmd, err := imap.Wait(dstConn.UIDSearch([]imap.Field{"HEADER", request.Header, request.Value}))
-			if err != nil {
-				log.Printf("Unable to search for message (%s): %s. skippin!", request.Value, err.Error())
-				continue
+			// requests from idle can come from any folder so make sure we're in the right one
+			if len(request.Folder.Name) > 0 {
+				if len(delim) == 0 {
+					var err error
+					err = conn.do(ctx, func(c Session) (err error) {
+						delim, err = getDelimiter(c)
+						return err
+					})
+					if err != nil {
+						log.Printf("Unable to get delimiter for (%s): %s. skippin!", request.Value, err.Error())
+						state.Fail()
+						continue
+					}
+				}
+				err := conn.do(ctx, func(c Session) error {
+					return SelectFolder(c, request.Folder.Path(delim), false)
+				})
+				if err != nil {
+					log.Printf("Unable to select %s for (%s): %s. skippin!", request.Folder.Name, request.Value, err.Error())
+					state.Fail()
+					continue
+				}
+			}
+
+			// if we already know where the message is, just update the flags
+			if request.Type == FlagWork {
+				if dstUID, ok := state.Lookup(request.UID); ok {
+					err := conn.do(ctx, func(c Session) error {
+						return SyncFlags(c, dstUID, request.Flags)
+					})
+					if err != nil {
+						log.Printf("Unable to sync flags for message (%s): %s", request.Value, err.Error())
+						state.Fail()
+					}
+					continue
+				}
+			}
+
+			// search for in dst unless a diff already told us it's missing
+			var results []uint32
+			var err error
+			if !request.Missing {
+				err = conn.do(ctx, func(c Session) (err error) {
+					results, err = findMessages(c, index, request.Value, request.Header)
+					return err
+				})
+				if err != nil {
+					log.Printf("Unable to search for message (%s): %s. skippin!", request.Value, err.Error())
+					state.Fail()
+					continue
+				}
 			}
 
-			results := cmd.Data[0].SearchResults()
 			// if not found, PULL from SRC and STORE in DST
 			if len(results) == 0 {
+				if request.Type == FlagWork {
+					log.Printf("Unable to update flags, message not found (%s). skippin!", request.Value)
+					continue
+				}
+
 				// only fetch if we dont have data already
 				if len(request.Msg.Body) == 0 {
 					// build and send fetch request
 					response := make(chan MessageData)
-					fr := fetchRequest{MessageId: request.Value, UID: request.UID, Response: response}
+					fr := fetchRequest{Key: request.Value, UID: request.UID, Response: response}
 					fetchRequests <- fr
 
 					// grab response from fetchers
@@ -131,19 +350,48 @@ func CheckAndAppendMessages(dstConn *imap.Client, storeRequests chan WorkRequest
 				}
 				if len(request.Msg.Body) == 0 {
 					log.Printf("No data found for from fetch request (%s). giving up", request.Value)
+					state.Fail()
 					continue
 				}
+				// cached data may hold stale flags
+				if request.Flags != nil {
+					request.Msg.Flags = request.Flags
+				}
 
-				err = AppendMessage(dstConn, request.Msg)
+				// an APPEND that was cut off may have gone through so it isn't retried
+				var dstUID uint32
+				err = conn.once(ctx, func(c Session) (err error) {
+					dstUID, err = AppendMessage(c, c.Selected().Name, request.Msg)
+					return err
+				})
 				if err != nil {
-					log.Printf("Problems appending message to dst: %s. quitting.", err.Error())
-					return
+					// keep draining the requests so the sync can wind down. the
+					// next sync will try the message again.
+					if err != ErrBudgetExceeded {
+						log.Printf("Problems appending message (%s) to dst: %s. giving up.", request.Value, err.Error())
+					}
+					state.Fail()
+					continue
 				}
+				state.Record(request.UID, dstUID)
+				index.Add(conn.Selected().Name, request.Value, dstUID)
 
+			} else if request.Flags != nil {
+				// the message exists, make sure its flags are up to date
+				state.Record(request.UID, results[0])
+				err = conn.do(ctx, func(c Session) error {
+					return SyncFlags(c, results[0], request.Flags)
+				})
+				if err != nil {
+					log.Printf("Unable to sync flags for message (%s): %s", request.Value, err.Error())
+					state.Fail()
+				}
+			} else {
+				state.Record(request.UID, results[0])
 			}
 
 		case <-timeout.C:
-			imap.Wait(dstConn.Noop())
+			conn.Noop()
 		}
 
 		if done {
@@ -156,13 +404,16 @@ func CheckAndAppendMessages(dstConn *imap.Client, storeRequests chan WorkRequest
 }
 
 type fetchRequest struct {
-	MessageId string
-	UID       uint32
-	Response  chan MessageData
+	// Key is the message's identity
+	Key      string
+	UID      uint32
+	Response chan MessageData
 }
 
-// FetchEmails will sit and wait for fetchRequests from the destination workers.
-func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache) {
+// FetchEmails will sit and wait for fetchRequests from the destination workers. If the
+// connection drops, it is brought back and the fetch is tried again.
+func fetchEmails(ctx context.Context, srcConn Session, requests chan fetchRequest, cache MessageCache) {
+	conn := &liveConn{Session: current(srcConn)}
 
 	// noop every few to keep things alive
 	timeout := time.NewTicker(NoopMinutes * time.Minute)
@@ -176,7 +427,7 @@ func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache) {
 			}
 			found := true
 			// check if the message body is in cache
-			data, err := cache.Get(request.MessageId)
+			data, err := cache.Get(request.Key)
 			if err != nil {
 				found = false
 				if err != ErrNotFound {
@@ -191,25 +442,38 @@ func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache) {
 				continue
 			}
 
-			msgData, err := FetchMessage(conn, request.UID)
+			var msgData MessageData
+			err = conn.do(ctx, func(c Session) (err error) {
+				msgData, err = FetchMessage(c, request.UID)
+				return err
+			})
 			if err != nil {
-				if err == NotFound {
+				switch err {
+				case NotFound:
+					// don't cache the empty message or it will be read back as a real one
 					log.Printf("No data found for UID: %d", request.UID)
-				} else {
-					log.Printf("Problems fetching message (%s) data: %s. Passing request and quitting.", request.MessageId, err.Error())
-					requests <- request
-					return
+					request.Response <- MessageData{}
+					continue
+				case ErrBudgetExceeded:
+					// the storer will give up on the message so the sync can wind down
+					request.Response <- msgData
+					continue
+				default:
+					// the storer will give up on the message and the next sync will pick it up
+					log.Printf("Problems fetching message (%s) data: %s. giving up.", request.Key, err.Error())
+					request.Response <- MessageData{}
+					continue
 				}
 			}
 			request.Response <- msgData
 
-			err = cache.Put(request.MessageId, msgData)
+			err = cache.Put(request.Key, msgData)
 			if err != nil {
-				log.Printf("Unable to add message (%s) to cache: %s", request.MessageId, err.Error())
+				log.Printf("Unable to add message (%s) to cache: %s", request.Key, err.Error())
 			}
 
 		case <-timeout.C:
-			imap.Wait(conn.Noop())
+			conn.Noop()
 		}
 
 		if done {
@@ -0,0 +1,132 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TLSConfig sets how to connect to an inbox's host. The zero value connects with
+// implicit TLS on port 993 and checks the certificate against the system's CAs.
+type TLSConfig struct {
+	// Mode is 'tls' (default), 'starttls' or 'plain'. 'plain' never encrypts anything,
+	// including the password, so it's only meant for test servers.
+	Mode string
+	// Port overrides the port in the Host. It's 993 for 'tls' and 143 otherwise by default.
+	Port int
+	// CAFile is a PEM bundle of CAs to trust instead of the system's.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key to present to the server.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the oldest TLS version to allow: '1.0', '1.1', '1.2' or '1.3'.
+	MinVersion string
+	// Fingerprint pins the server's certificate to its hex SHA-256 fingerprint. If it's set,
+	// the certificate is only checked against the fingerprint so self-signed ones work.
+	Fingerprint string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (t TLSConfig) Validate() error {
+	switch t.mode() {
+	case "tls", "starttls", "plain":
+	default:
+		return errors.New("Unknown TLS mode: " + t.Mode)
+	}
+
+	if (t.Port < 0) || (t.Port > 65535) {
+		return errors.New("TLS port is out of range.")
+	}
+
+	if _, ok := tlsVersions[t.MinVersion]; (len(t.MinVersion) > 0) && !ok {
+		return errors.New("Unknown TLS version: " + t.MinVersion)
+	}
+
+	if (len(t.CertFile) > 0) != (len(t.KeyFile) > 0) {
+		return errors.New("A client certificate needs both a CertFile and a KeyFile.")
+	}
+
+	if fingerprint := t.fingerprint(); (len(fingerprint) > 0) && (len(fingerprint) != sha256.Size*2) {
+		return errors.New("TLS fingerprint must be a hex SHA-256 hash.")
+	}
+	return nil
+}
+
+func (t TLSConfig) mode() string {
+	if len(t.Mode) == 0 {
+		return "tls"
+	}
+	return strings.ToLower(t.Mode)
+}
+
+// fingerprint normalizes the pinned fingerprint so 'AB:CD:...' works too.
+func (t TLSConfig) fingerprint() string {
+	return strings.ToLower(strings.Replace(t.Fingerprint, ":", "", -1))
+}
+
+// address returns the host and the host:port to dial.
+func (t TLSConfig) address(host string) (string, string) {
+	port := "993"
+	if t.mode() != "tls" {
+		port = "143"
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	if t.Port > 0 {
+		port = strconv.Itoa(t.Port)
+	}
+	return host, net.JoinHostPort(host, port)
+}
+
+// config builds the tls.Config for connecting to serverName.
+func (t TLSConfig) config(serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tlsVersions[t.MinVersion]}
+
+	if len(t.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + t.CAFile)
+		}
+	}
+
+	if len(t.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if fingerprint := t.fingerprint(); len(fingerprint) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return errors.New("server certificate doesn't match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,57 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTLSAddress(t *testing.T) {
+	tests := []struct {
+		config   TLSConfig
+		host     string
+		expected string
+	}{
+		{TLSConfig{}, "imap.example.com", "imap.example.com:993"},
+		{TLSConfig{Mode: "starttls"}, "imap.example.com", "imap.example.com:143"},
+		{TLSConfig{Mode: "plain"}, "imap.example.com:1143", "imap.example.com:1143"},
+		{TLSConfig{Port: 10993}, "imap.example.com:993", "imap.example.com:10993"},
+	}
+
+	for _, test := range tests {
+		if _, addr := test.config.address(test.host); addr != test.expected {
+			t.Errorf("address(%q) with %+v returned %q - expected %q", test.host, test.config, addr, test.expected)
+		}
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	pinned := TLSConfig{Fingerprint: strings.ToUpper(hex.EncodeToString(sum[:]))}
+	if err := pinned.Validate(); err != nil {
+		t.Errorf("valid fingerprint failed validation: %s", err.Error())
+	}
+
+	config, _ := pinned.config("example.com")
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Errorf("unable to connect with the pinned certificate: %s", err.Error())
+	} else {
+		conn.Close()
+	}
+
+	sum[0]++
+	config, _ = TLSConfig{Fingerprint: hex.EncodeToString(sum[:])}.config("example.com")
+	if conn, err = tls.Dial("tcp", addr, config); err == nil {
+		conn.Close()
+		t.Error("connected even though the certificate didn't match the pinned fingerprint")
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"copycat-imap/copycat"
 
@@ -30,17 +35,47 @@ var (
 
 	// single run or idle and wait
 	idle       = flag.Bool("idle", false, "Sync the mailboxes and then idle and wait for updates. Creates an additional connection for each inbox.")
+	idleConns  = flag.Int("idle-conns", copycat.MaxIdleConns, "The most source folders to IDLE on with a connection each, INBOX first. The rest share one connection that polls them every minute.")
 	sync       = flag.Bool("sync", true, "Run a sync of the mailboxes. Flag helpful for skipping sync with bandwidth usage is limited.")
 	purge      = flag.Bool("purge", false, "During the sync this will purge any destination messages that do not exist in the source.")
 	quicksync  = flag.Bool("quick", false, "Starts a quick sync that will only look to 'sync' the last 'quick-count' messages.")
 	quickcount = flag.Int("quick-count", 500, "The number of messages to look for with a quick scan.")
 
+	// show what a sync would do without doing it
+	dryRun     = flag.Bool("dry-run", false, "Print what a sync (and purge, if -purge is set) would append, update and delete in each destination without changing anything.")
+	planFormat = flag.String("plan-format", "text", "The format of the -dry-run plan: 'text' or 'json'.")
+
+	// which folders to sync
+	include = flag.String("include", "", "Comma separated list of folder patterns to sync (ie. 'INBOX,Work/*'). All folders are synced by default.")
+	exclude = flag.String("exclude", "", "Comma separated list of folder patterns to skip (ie. '[Gmail]/All Mail,Spam').")
+
+	// how to match up messages between inboxes
+	identityName = flag.String("identity", "", "How messages are matched up between inboxes: 'message-id' (default), 'header-hash' or 'body-digest'. Messages without a Message-Id always fall back to 'header-hash'.")
+
 	// # of IMAP connections per mailbox
 	conns = flag.Int("c", 2, "The number of concurrent IMAP connections for each inbox during Syncing. Large #s may run faster but you may risk reaching connection/bandwidth limits for you email provider.")
 
+	// stay under the provider's transfer limits
+	dailyBudget = flag.Int64("daily-budget", 0, "The most message data in bytes to fetch from or append to each inbox per day. Inboxes with a 'dailyBudget' in the config use their own. No limit by default.")
+
+	// # of messages fetched at a time while paging through a folder
+	chunkSize = flag.Int("chunk-size", copycat.ChunkSize, "The number of messages to fetch at a time while paging through a folder. Lower this to use less memory on huge mailboxes.")
+
+	// how often to look for flag changes on servers without CONDSTORE
+	flagScan = flag.Int("flag-scan", copycat.FlagScanInterval, "If the source doesn't support CONDSTORE, compare the flags of every message after this many syncs of a folder. 0 turns it off.")
+
 	// accept log file too
 	logFile = flag.String("log", "", "Location to write logs to. stderr by default. If set, a HUP signal will handle logrotate.")
 	dbFile  = flag.String("db", "/var/copycat/messages", "path for message storage")
+
+	// where to cache messages
+	cacheType      = flag.String("cache", "", "Where to cache messages: 'leveldb' (default), 'fs', 'bolt', 'memory' or 'memcache'. The leveldb, fs and bolt caches are kept at the -db path.")
+	cacheMaxBytes  = flag.Int64("cache-max-bytes", 0, "The most message data to keep in the leveldb cache. The least recently used messages are evicted past this. No limit by default.")
+	cacheMaxAge    = flag.String("cache-max-age", "", "How long to keep messages in the leveldb cache (ie. '720h'). No limit by default.")
+	cacheCompress  = flag.String("cache-compression", "", "Compress cached messages with 'gzip' or 'zstd'. Off by default.")
+	cacheKeyFile   = flag.String("cache-key-file", "", "A file holding a hex or base64 encoded AES key. If set, cached messages are encrypted with AES-GCM.")
+	cacheKeyEnv    = flag.String("cache-key-env", "", "The name of an environment variable holding a hex or base64 encoded AES key. If set, cached messages are encrypted with AES-GCM.")
+	memcacheServer = flag.String("memcache", "", "Comma separated list of memcached servers (ie. 'localhost:11211') to cache messages in. Implies -cache=memcache. The sync state is always kept next to -db.")
 )
 
 func main() {
@@ -52,12 +87,31 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "cache" {
+		cacheCommand(flag.Args()[1:])
+		return
+	}
+
 	if *conns <= 0 {
 		*conns = 10
 	}
 
+	if *chunkSize > 0 {
+		copycat.ChunkSize = *chunkSize
+	}
+
+	if *flagScan >= 0 {
+		copycat.FlagScanInterval = *flagScan
+	}
+
+	if *idleConns >= 0 {
+		copycat.MaxIdleConns = *idleConns
+	}
+
 	var srcInfo copycat.InboxInfo
 	var dstInfos []copycat.InboxInfo
+	var folders copycat.FolderFilter
+	var cache copycat.CacheConfig
 
 	if len(*configFile) == 0 {
 		// put together info from input
@@ -71,20 +125,10 @@ func main() {
 		dstInfos = append(dstInfos, dstInfo)
 
 	} else {
-		//READ THE CONFIG FILE
-		cFile, err := os.Open(*configFile)
-		errCheck(err, "Config File")
-
-		configBytes, err := ioutil.ReadAll(cFile)
-		errCheck(err, "Config File")
-		cFile.Close()
-
-		var config copycat.Config
-		err = json.Unmarshal(configBytes, &config)
-		errCheck(err, "Config File")
+		config := readConfig(*configFile)
 
 		srcInfo = config.Source
-		err = srcInfo.Validate()
+		err := srcInfo.Validate()
 		errCheck(err, "Source Creds")
 
 		dstInfos = config.Dest
@@ -92,6 +136,41 @@ func main() {
 			err = info.Validate()
 			errCheck(err, "Destination Creds")
 		}
+
+		folders = config.Folders
+		cache = config.Cache
+		if len(*identityName) == 0 {
+			*identityName = config.Identity
+		}
+	}
+
+	if srcInfo.DailyBudget == 0 {
+		srcInfo.DailyBudget = *dailyBudget
+	}
+	for i := range dstInfos {
+		if dstInfos[i].DailyBudget == 0 {
+			dstInfos[i].DailyBudget = *dailyBudget
+		}
+	}
+
+	// flags add on to any folder patterns from the config
+	folders.Include = append(folders.Include, splitList(*include)...)
+	folders.Exclude = append(folders.Exclude, splitList(*exclude)...)
+	errCheck(folders.Validate(), "Folder Patterns")
+
+	identity, err := copycat.NewIdentity(*identityName)
+	errCheck(err, "Identity")
+
+	cache = cacheConfig(cache)
+
+	if (*planFormat != "text") && (*planFormat != "json") {
+		errCheck(fmt.Errorf("unknown format '%s'", *planFormat), "Plan Format")
+	}
+	// a dry run only needs a single connection to each inbox and never idles
+	if *dryRun {
+		*sync = true
+		*idle = false
+		*conns = 1
 	}
 
 	// check log flag, setup logger if set.
@@ -101,30 +180,118 @@ func main() {
 		go utils.ListenForLogSignal(logger)
 	}
 
-start:
-	cat, err := copycat.NewCopyCat(srcInfo, dstInfos, *conns, *sync, *idle)
-	if err != nil {
-		log.Printf("Problems creating new copycat: %s", err.Error())
-	}
-
 	if !*quicksync {
 		*quickcount = 0
 	}
 
-	switch {
-	case *idle:
-		cat.Idle(*sync, *purge, *dbFile)
-		// if idle ended, something's up. just restart.
-		log.Printf("Idle unexpectedly quit. attempting to close conns...")
-		cat.Close()
-		log.Print("Conns closed. restarting process.")
-		goto start
-	case *sync:
-		cat.Sync(*purge, *dbFile, *quickcount)
-		cat.Close()
+	// stop whatever is running on an interrupt. a second one kills the process.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		log.Printf("Received interrupt. Shutting down...")
+		signal.Stop(interrupt)
+		cancel()
+	}()
+
+	// if the connections can't be made or idle gives up, try again after a growing delay
+	backoff := copycat.NewBackoff()
+	for {
+		cat, err := copycat.NewCopyCat(copycat.Options{
+			Source:        srcInfo,
+			Dest:          dstInfos,
+			Folders:       folders,
+			Identity:      identity,
+			Cache:         cache,
+			ConnsPerInbox: *conns,
+			Sync:          *sync,
+			Idle:          *idle,
+		})
+		if err != nil {
+			log.Printf("Problems creating new copycat: %s", err.Error())
+			cat.Close()
+			if !*idle {
+				os.Exit(1)
+			}
+			if !restart(ctx, backoff) {
+				return
+			}
+			continue
+		}
+
+		opts := copycat.SyncOptions{Purge: *purge, DBFile: *dbFile, QuickSyncCount: *quickcount, InitialSync: *sync}
+		switch {
+		case *dryRun:
+			plan, err := cat.Plan(ctx, opts)
+			cat.Close()
+			if err != nil {
+				log.Printf("Problems running dry run: %s", err.Error())
+				os.Exit(1)
+			}
+
+			if *planFormat == "json" {
+				err = plan.WriteJSON(os.Stdout)
+			} else {
+				err = plan.WriteText(os.Stdout)
+			}
+			if err != nil {
+				log.Printf("Problems writing plan: %s", err.Error())
+				os.Exit(1)
+			}
+			return
+		case *idle:
+			started := time.Now()
+			err = cat.Idle(ctx, opts)
+			log.Printf("Idle stopped. attempting to close conns...")
+			cat.Close()
+			if (err == nil) || (ctx.Err() != nil) {
+				return
+			}
+
+			// if idle ended on its own, something's up. restart once things settle down.
+			log.Printf("Idle unexpectedly quit: %s", err.Error())
+			if time.Since(started) > copycat.ReconnectMax {
+				backoff.Reset()
+			}
+			if !restart(ctx, backoff) {
+				return
+			}
+		case *sync:
+			err = cat.Sync(ctx, opts)
+			cat.Close()
+			if err == copycat.ErrBudgetExceeded {
+				log.Print("Stopped the sync to stay within the daily bandwidth budget. Run it again tomorrow to pick up where it left off.")
+				os.Exit(budgetExitCode)
+			}
+			if (err != nil) && (ctx.Err() == nil) {
+				log.Printf("Problems running sync: %s", err.Error())
+				os.Exit(1)
+			}
+			return
+		default:
+			cat.Close()
+			return
+		}
 	}
 }
 
+// restart will wait a while before trying again. It returns false if ctx is done first.
+func restart(ctx context.Context, backoff *copycat.Backoff) bool {
+	wait := backoff.Next()
+	log.Printf("restarting in %s...", wait)
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// budgetExitCode is returned when a sync stops because it ran out of bandwidth.
+const budgetExitCode = 3
+
 func errCheck(err error, msg string) {
 	if err != nil {
 		log.Printf("Invalid %s: %s", msg, err.Error())
@@ -132,6 +299,57 @@ func errCheck(err error, msg string) {
 	}
 }
 
+// readConfig will load the json config file.
+func readConfig(path string) (config copycat.Config) {
+	cFile, err := os.Open(path)
+	errCheck(err, "Config File")
+
+	configBytes, err := ioutil.ReadAll(cFile)
+	errCheck(err, "Config File")
+	cFile.Close()
+
+	err = json.Unmarshal(configBytes, &config)
+	errCheck(err, "Config File")
+	return config
+}
+
+// cacheConfig will apply any cache flags on top of the config's cache. flags win.
+func cacheConfig(cache copycat.CacheConfig) copycat.CacheConfig {
+	if len(*memcacheServer) > 0 {
+		cache.Type = "memcache"
+		cache.Servers = splitList(*memcacheServer)
+	}
+	if len(*cacheType) > 0 {
+		cache.Type = *cacheType
+	}
+	if *cacheMaxBytes > 0 {
+		cache.MaxBytes = *cacheMaxBytes
+	}
+	if len(*cacheMaxAge) > 0 {
+		cache.MaxAge = *cacheMaxAge
+	}
+	if len(*cacheCompress) > 0 {
+		cache.Compression = *cacheCompress
+	}
+	if len(*cacheKeyFile) > 0 {
+		cache.KeyFile = *cacheKeyFile
+	}
+	if len(*cacheKeyEnv) > 0 {
+		cache.KeyEnv = *cacheKeyEnv
+	}
+	errCheck(cache.Validate(), "Cache")
+	return cache
+}
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getExampleConfig() string {
 	return `
 	
@@ -139,20 +357,49 @@ func getExampleConfig() string {
 	    "source": {
 	        "user": "source_user_name",
 	        "pw": "source_pa$$w0rd",
-	        "host": "imap.source.com"
+	        "host": "imap.source.com",
+	        "dailyBudget": 2000000000
 	    },
 	    "dest": [
 	        {
 	            "user": "dest1_user_name",
 	            "pw": "dest1_pa$$w0rd",
-	            "host": "imap.dest1.com"
+	            "host": "imap.dest1.com",
+	            "rateLimit": {
+	                "commandsPerSecond": 5,
+	                "bytesPerSecond": 1000000
+	            }
 	        },
 	        {
 	            "user": "dest2_user_name",
-	            "pw": "dest2_pa$$w0rd",
-	            "host": "imap.dest2.com"
+	            "host": "imap.dest2.com",
+	            "oauth": {
+	                "mechanism": "xoauth2",
+	                "tokenURL": "https://oauth2.googleapis.com/token",
+	                "clientID": "1234.apps.googleusercontent.com",
+	                "clientSecret": "client_secret",
+	                "refreshToken": "1//refresh_token"
+	            },
+	            "purge": {
+	                "mode": "move",
+	                "folder": "Copycat/Purged"
+	            }
 	        }
-	    ]
+	    ],
+	    "folders": {
+	        "include": ["*"],
+	        "exclude": ["[Gmail]/All Mail", "[Gmail]/Spam"]
+	    },
+	    "identity": "message-id",
+	    "cache": {
+	        "type": "leveldb",
+	        "path": "/var/copycat/messages",
+	        "maxBytes": 10737418240,
+	        "maxAge": "2160h",
+	        "ageBy": "internal-date",
+	        "compression": "zstd",
+	        "keyFile": "/etc/copycat/cache.key"
+	    }
 	}
 	
 `